@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is the prefix of environment variables that override config
+// fields, e.g. SPOTSHOT_SPOTIFY_CLIENT_ID overrides spotify.client_id.
+const envPrefix = "SPOTSHOT"
+
+// Config contains app config details.
+type Config struct {
+	Spotify struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret" secret:"true"`
+		RedirectURI  string `json:"redirect_uri"`
+	}
+	App struct {
+		Port                             int
+		SessionEncryptionKeyFilename     string `json:"session_encryption_key_filename"`
+		SessionAuthenticationKeyFilename string `json:"session_authentication_key_filename"`
+		CSRFAuthenticationKeyFilename    string `json:"csrf_authentication_key_filename"`
+		// MetricsPort is where Prometheus metrics are served, kept off the
+		// public port. Metrics are turned off if it's 0.
+		MetricsPort int `json:"metrics_port"`
+		// AdminUserIDs are the Spotify user IDs allowed to use the admin pages.
+		AdminUserIDs []string `json:"admin_user_ids"`
+		// BaseURL is where the app is served from, for links in emails and
+		// elsewhere. It defaults to the scheme and host of the redirect URI.
+		BaseURL string `json:"base_url"`
+	}
+	Redis struct {
+		Addr string
+		// Addrs is a list of Sentinel or Cluster node addresses, used instead of Addr.
+		Addrs []string
+		// MasterName is the Sentinel master name. If set, Addrs are Sentinel nodes.
+		MasterName       string `json:"master_name"`
+		SessionKeyPrefix string `json:"session_key_prefix"`
+	}
+	SMTP struct {
+		// Addr is the SMTP server's host:port. Emails are turned off if it's empty.
+		Addr     string
+		Username string
+		Password string `secret:"true"`
+		// From is the address emails are sent from, e.g. "Spotshot <noreply@example.com>".
+		From string
+	}
+}
+
+// loadConfig reads the config file, if there is one, then applies overrides
+// from the environment. A missing file is only an error if required is set,
+// so the app can be configured from the environment alone.
+func loadConfig(filename string, required bool) (*Config, error) {
+	cfg := new(Config)
+	cfg.App.Port = 80
+	cfg.App.MetricsPort = 9090
+	f, err := os.Open(filename)
+	switch {
+	case os.IsNotExist(err) && !required:
+	case err != nil:
+		return nil, fmt.Errorf("couldn't open config file: %w", err)
+	default:
+		defer f.Close()
+		err = json.NewDecoder(f).Decode(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode JSON in config file: %w", err)
+		}
+	}
+	err = applyEnv(cfg, os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.App.BaseURL == "" {
+		if u, err := url.Parse(cfg.Spotify.RedirectURI); err == nil && u.Host != "" {
+			cfg.App.BaseURL = fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+		}
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides config fields with environment variables. Each field
+// can be set with SPOTSHOT_<SECTION>_<FIELD>, or read from the file named by
+// SPOTSHOT_<SECTION>_<FIELD>_FILE, which is handy for Docker and Kubernetes
+// secrets. Lists are comma separated.
+func applyEnv(cfg *Config, lookupEnv func(string) (string, bool)) error {
+	return walkConfig(cfg, func(name string, field reflect.Value, secret bool) error {
+		val, ok := lookupEnv(name)
+		if filename, fileOK := lookupEnv(name + "_FILE"); fileOK {
+			if ok {
+				return fmt.Errorf("only one of %s and %s_FILE can be set", name, name)
+			}
+			b, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return fmt.Errorf("couldn't read %s_FILE: %w", name, err)
+			}
+			val, ok = strings.TrimRight(string(b), "\r\n"), true
+		}
+		if !ok {
+			return nil
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(val)
+		case reflect.Int:
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("%s must be a number, got %q", name, val)
+			}
+			field.SetInt(int64(i))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false, got %q", name, val)
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			var vals []string
+			for _, v := range strings.Split(val, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					vals = append(vals, v)
+				}
+			}
+			field.Set(reflect.ValueOf(vals))
+		default:
+			return fmt.Errorf("%s can't be set from the environment", name)
+		}
+		return nil
+	})
+}
+
+// walkConfig calls fn with the environment variable name of each config field.
+func walkConfig(cfg *Config, fn func(name string, field reflect.Value, secret bool) error) error {
+	sections := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionName := strings.ToUpper(sections.Type().Field(i).Name)
+		for j := 0; j < section.NumField(); j++ {
+			sf := section.Type().Field(j)
+			name := strings.ToLower(sf.Name)
+			if tag := strings.Split(sf.Tag.Get("json"), ",")[0]; tag != "" {
+				name = tag
+			}
+			envName := fmt.Sprintf("%s_%s_%s", envPrefix, sectionName, strings.ToUpper(name))
+			err := fn(envName, section.Field(j), sf.Tag.Get("secret") == "true")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the config has everything the app needs to run.
+func (cfg *Config) validate() error {
+	var errs []string
+	if cfg.Spotify.ClientID == "" {
+		errs = append(errs, "spotify.client_id is required, get one from https://developer.spotify.com/dashboard")
+	}
+	if cfg.Spotify.RedirectURI == "" {
+		errs = append(errs, "spotify.redirect_uri is required, e.g. https://example.com/callback")
+	}
+	if cfg.App.Port <= 0 || cfg.App.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("app.port must be between 1 and 65535, got %d", cfg.App.Port))
+	}
+	if cfg.App.MetricsPort < 0 || cfg.App.MetricsPort > 65535 {
+		errs = append(errs, fmt.Sprintf("app.metrics_port must be between 0 and 65535, got %d", cfg.App.MetricsPort))
+	} else if cfg.App.MetricsPort == cfg.App.Port {
+		errs = append(errs, fmt.Sprintf("app.metrics_port must differ from app.port, got %d for both", cfg.App.Port))
+	}
+	if cfg.App.SessionEncryptionKeyFilename == "" {
+		errs = append(errs, "app.session_encryption_key_filename is required")
+	}
+	if cfg.App.SessionAuthenticationKeyFilename == "" {
+		errs = append(errs, "app.session_authentication_key_filename is required")
+	}
+	if cfg.App.CSRFAuthenticationKeyFilename == "" {
+		errs = append(errs, "app.csrf_authentication_key_filename is required")
+	}
+	if cfg.Redis.Addr == "" && len(cfg.Redis.Addrs) == 0 {
+		errs = append(errs, "one of redis.addr and redis.addrs is required")
+	}
+	if cfg.Redis.MasterName != "" && len(cfg.Redis.Addrs) == 0 {
+		errs = append(errs, "redis.addrs must list the Sentinel nodes when redis.master_name is set")
+	}
+	if u, err := url.Parse(cfg.App.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Sprintf("app.base_url must be an absolute URL, e.g. https://example.com, got %q", cfg.App.BaseURL))
+	}
+	if cfg.SMTP.Addr != "" {
+		if _, err := mail.ParseAddress(cfg.SMTP.From); err != nil {
+			errs = append(errs, fmt.Sprintf("smtp.from must be an email address when smtp.addr is set, got %q", cfg.SMTP.From))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// print writes the config as JSON, with secrets redacted.
+func (cfg *Config) print(w io.Writer) error {
+	redacted := *cfg
+	err := walkConfig(&redacted, func(name string, field reflect.Value, secret bool) error {
+		if secret && field.Kind() == reflect.String && field.String() != "" {
+			field.SetString("REDACTED")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(redacted, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spotshot")
+	if err != nil {
+		t.Fatalf("couldn't make temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "client_secret")
+	err = ioutil.WriteFile(secretFile, []byte("shh\n"), 0600)
+	if err != nil {
+		t.Fatalf("couldn't write secret file: %s", err)
+	}
+
+	env := map[string]string{
+		"SPOTSHOT_SPOTIFY_CLIENT_ID":          "id",
+		"SPOTSHOT_SPOTIFY_CLIENT_SECRET_FILE": secretFile,
+		"SPOTSHOT_APP_PORT":                   "8080",
+		"SPOTSHOT_REDIS_ADDRS":                "redis-1:26379, redis-2:26379",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		val, ok := env[name]
+		return val, ok
+	}
+	cfg := new(Config)
+	cfg.Spotify.ClientID = "from file"
+	cfg.Redis.Addr = "localhost:6379"
+	err = applyEnv(cfg, lookupEnv)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cfg.Spotify.ClientID != "id" {
+		t.Errorf("expected client ID id, got %s", cfg.Spotify.ClientID)
+	}
+	if cfg.Spotify.ClientSecret != "shh" {
+		t.Errorf("expected client secret from file, got %q", cfg.Spotify.ClientSecret)
+	}
+	if cfg.App.Port != 8080 {
+		t.Errorf("expected port 8080, got %d", cfg.App.Port)
+	}
+	if want := []string{"redis-1:26379", "redis-2:26379"}; !reflect.DeepEqual(cfg.Redis.Addrs, want) {
+		t.Errorf("expected addrs %v, got %v", want, cfg.Redis.Addrs)
+	}
+	if cfg.Redis.Addr != "localhost:6379" {
+		t.Errorf("expected unset fields to be kept, got addr %s", cfg.Redis.Addr)
+	}
+
+	env["SPOTSHOT_APP_PORT"] = "eighty"
+	if err := applyEnv(new(Config), lookupEnv); err == nil {
+		t.Errorf("expected error for invalid port")
+	}
+}
+
+func TestConfigPrintRedactsSecrets(t *testing.T) {
+	cfg := new(Config)
+	cfg.Spotify.ClientID = "id"
+	cfg.Spotify.ClientSecret = "shh"
+	var buf bytes.Buffer
+	err := cfg.print(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Contains(buf.String(), "shh") {
+		t.Errorf("expected client secret to be redacted, got %s", buf.String())
+	}
+	if cfg.Spotify.ClientSecret != "shh" {
+		t.Errorf("expected config to be left alone, got client secret %q", cfg.Spotify.ClientSecret)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := new(Config)
+	err := cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), "spotify.client_id is required") {
+		t.Errorf("expected missing client ID error, got %v", err)
+	}
+
+	cfg.Spotify.ClientID = "id"
+	cfg.Spotify.RedirectURI = "http://localhost/callback"
+	cfg.App.Port = 80
+	cfg.App.SessionEncryptionKeyFilename = "enc"
+	cfg.App.SessionAuthenticationKeyFilename = "auth"
+	cfg.App.CSRFAuthenticationKeyFilename = "csrf"
+	cfg.App.BaseURL = "http://localhost"
+	cfg.Redis.Addr = "localhost:6379"
+	err = cfg.validate()
+	if err != nil {
+		t.Errorf("expected valid config, got %s", err)
+	}
+
+	cfg.App.MetricsPort = 80
+	err = cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), "app.metrics_port must differ from app.port") {
+		t.Errorf("expected metrics port clash error, got %v", err)
+	}
+}
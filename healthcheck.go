@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthcheckTimeout is how long the healthcheck waits for the app to answer.
+const healthcheckTimeout = 5 * time.Second
+
+// healthcheck checks the app running at url is ready. It's for container
+// healthchecks, since the image has no shell or curl to do it with.
+func healthcheck(url string) error {
+	client := &http.Client{Timeout: healthcheckTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("couldn't reach app: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("app isn't ready: %s", resp.Status)
+	}
+	return nil
+}
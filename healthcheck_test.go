@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthcheck(t *testing.T) {
+	ready := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/readyz" {
+			t.Errorf("expected request to /readyz, got %s", r.URL.Path)
+		}
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	if err := healthcheck(ts.URL + "/readyz"); err != nil {
+		t.Errorf("expected app to be ready, got %s", err)
+	}
+	ready = false
+	if err := healthcheck(ts.URL + "/readyz"); err == nil {
+		t.Errorf("expected error when app isn't ready")
+	}
+	ts.Close()
+	if err := healthcheck(ts.URL + "/readyz"); err == nil {
+		t.Errorf("expected error when app isn't running")
+	}
+}
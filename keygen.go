@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// previousKeySuffix is added to the filename of a session key when it's
+// rotated. Previous keys are still accepted, so existing sessions stay valid
+// until they expire or the previous key files are deleted.
+const previousKeySuffix = ".previous"
+
+// secretKey is a key file the app needs.
+type secretKey struct {
+	name     string
+	filename string
+	size     int
+	// rotatable keys are kept around as previous keys when rotated.
+	rotatable bool
+}
+
+func secretKeys(cfg *Config) []secretKey {
+	return []secretKey{
+		// HMAC-SHA256 authentication keys are recommended to be 32 or 64 bytes.
+		{"session authentication", cfg.App.SessionAuthenticationKeyFilename, 64, true},
+		// 32 bytes selects AES-256.
+		{"session encryption", cfg.App.SessionEncryptionKeyFilename, 32, true},
+		// gorilla/csrf needs a 32 byte key. It only supports one key at a time,
+		// so rotating it invalidates any forms that are open.
+		{"CSRF authentication", cfg.App.CSRFAuthenticationKeyFilename, 32, false},
+	}
+}
+
+// keygen writes new random keys to the configured key files.
+func keygen(cfg *Config, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	fs.SetOutput(out)
+	force := fs.Bool("f", false, "overwrite existing keys")
+	rotate := fs.Bool("rotate", false, "replace the session keys, keeping the current ones as previous keys so existing sessions stay valid")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	keys := secretKeys(cfg)
+	var existing []string
+	for _, key := range keys {
+		if key.filename == "" {
+			return fmt.Errorf("no filename configured for the %s key", key.name)
+		}
+		_, err := os.Stat(key.filename)
+		if err == nil {
+			existing = append(existing, key.filename)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("couldn't check %s key: %w", key.name, err)
+		}
+	}
+	if len(existing) > 0 && !*force && !*rotate {
+		return fmt.Errorf("keys already exist, use -rotate or -f to replace them: %s", strings.Join(existing, ", "))
+	}
+
+	for _, key := range keys {
+		_, err := os.Stat(key.filename)
+		exists := err == nil
+		if exists && *rotate && !*force && !key.rotatable {
+			fmt.Fprintf(out, "kept %s key %s, use -f to replace it\n", key.name, key.filename)
+			continue
+		}
+		if exists && *rotate && key.rotatable {
+			err = os.Rename(key.filename, key.filename+previousKeySuffix)
+			if err != nil {
+				return fmt.Errorf("couldn't keep previous %s key: %w", key.name, err)
+			}
+			fmt.Fprintf(out, "moved %s key to %s\n", key.name, key.filename+previousKeySuffix)
+		}
+		err = writeKey(key.filename, key.size)
+		if err != nil {
+			return fmt.Errorf("couldn't write %s key: %w", key.name, err)
+		}
+		fmt.Fprintf(out, "wrote %d byte %s key to %s\n", key.size, key.name, key.filename)
+	}
+	return nil
+}
+
+func writeKey(filename string, size int) error {
+	key := make([]byte, size)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// The file may have existed with looser permissions.
+	err = f.Chmod(0600)
+	if err == nil {
+		_, err = f.Write(key)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readSessionKeys returns the session store's authentication and encryption
+// key pairs, starting with the current keys followed by the previous keys, if
+// there are any.
+func readSessionKeys(cfg *Config) ([][]byte, error) {
+	var keyPairs [][]byte
+	for _, suffix := range []string{"", previousKeySuffix} {
+		authKey, err := ioutil.ReadFile(cfg.App.SessionAuthenticationKeyFilename + suffix)
+		if suffix != "" && errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read session authentication key: %w", err)
+		}
+		encKey, err := ioutil.ReadFile(cfg.App.SessionEncryptionKeyFilename + suffix)
+		if suffix != "" && errors.Is(err, os.ErrNotExist) {
+			// Keys are no use without the rest of their pair.
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read session encryption key: %w", err)
+		}
+		keyPairs = append(keyPairs, authKey, encKey)
+	}
+	return keyPairs, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeygen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spotshot")
+	if err != nil {
+		t.Fatalf("couldn't make temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := new(Config)
+	cfg.App.SessionAuthenticationKeyFilename = filepath.Join(dir, "keys", "session_auth")
+	cfg.App.SessionEncryptionKeyFilename = filepath.Join(dir, "keys", "session_enc")
+	cfg.App.CSRFAuthenticationKeyFilename = filepath.Join(dir, "keys", "csrf_auth")
+
+	err = keygen(cfg, nil, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, key := range secretKeys(cfg) {
+		info, err := os.Stat(key.filename)
+		if err != nil {
+			t.Fatalf("expected %s key to be written: %s", key.name, err)
+		}
+		if info.Size() != int64(key.size) {
+			t.Errorf("expected %s key to be %d bytes, got %d", key.name, key.size, info.Size())
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("expected %s key to have permissions 0600, got %o", key.name, perm)
+		}
+	}
+
+	// Existing keys shouldn't be overwritten by accident.
+	csrfKey, _ := ioutil.ReadFile(cfg.App.CSRFAuthenticationKeyFilename)
+	err = keygen(cfg, nil, ioutil.Discard)
+	if err == nil {
+		t.Fatalf("expected error when keys already exist")
+	}
+
+	// Rotating keeps the session keys as previous keys, but not the CSRF key.
+	err = keygen(cfg, []string{"-rotate"}, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	keyPairs, err := readSessionKeys(cfg)
+	if err != nil {
+		t.Fatalf("couldn't read session keys: %s", err)
+	}
+	if len(keyPairs) != 4 {
+		t.Fatalf("expected current and previous key pairs, got %d keys", len(keyPairs))
+	}
+	if string(keyPairs[0]) == string(keyPairs[2]) {
+		t.Errorf("expected session authentication key to be replaced")
+	}
+	if newCSRFKey, _ := ioutil.ReadFile(cfg.App.CSRFAuthenticationKeyFilename); string(newCSRFKey) != string(csrfKey) {
+		t.Errorf("expected CSRF key to be kept")
+	}
+}
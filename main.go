@@ -2,41 +2,35 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"spotshot/pkg/spotshot"
 
-	"github.com/boj/redistore"
 	"github.com/go-redis/redis"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/zmb3/spotify"
 )
 
-// Config contains app config details.
-type Config struct {
-	Spotify struct {
-		ClientID     string `json:"client_id"`
-		ClientSecret string `json:"client_secret"`
-		RedirectURI  string `json:"redirect_uri"`
-	}
-	App struct {
-		Port                             int
-		SessionEncryptionKeyFilename     string `json:"session_encryption_key_filename"`
-		SessionAuthenticationKeyFilename string `json:"session_authentication_key_filename"`
-		CSRFAuthenticationKeyFilename    string `json:"csrf_authentication_key_filename"`
-	}
-	Redis struct {
-		Addr string
-	}
-}
+// shutdownTimeout is how long in-flight requests and playlists are given to
+// finish once the app is told to stop.
+const shutdownTimeout = 20 * time.Second
+
+// apiPrefix is where the JSON API lives. Only requests under it can use API
+// tokens.
+const apiPrefix = "/api/v1"
 
 var (
 	// Version is the current version.
@@ -46,8 +40,12 @@ var (
 )
 
 func main() {
-	cfgFilepath := flag.String("c", "cfg/config.json", "path to configuration file")
+	cfgFilepath := flag.String("c", "cfg/config.json", "path to configuration file, which is optional if configured by SPOTSHOT_* environment variables")
 	versionFlag := flag.Bool("v", false, "print version and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [config print | keygen [-f] [-rotate] | healthcheck]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if *versionFlag {
@@ -58,59 +56,145 @@ func main() {
 	logger := logrus.New()
 	logger.Out = os.Stdout
 
-	// Parse config file.
-	var cfg Config
-	cfgFile, err := os.Open(*cfgFilepath)
+	// Load config from the file and environment. The file only has to exist
+	// if it was asked for.
+	cfgRequired := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "c" {
+			cfgRequired = true
+		}
+	})
+	cfg, err := loadConfig(*cfgFilepath, cfgRequired)
 	if err != nil {
-		logger.Errorf("err opening cfg file: %s", err)
+		logger.Errorf("err loading config: %s", err)
 		os.Exit(1)
 	}
-	decoder := json.NewDecoder(cfgFile)
-	err = decoder.Decode(&cfg)
+
+	switch strings.Join(flag.Args(), " ") {
+	case "":
+	case "config print":
+		err = cfg.print(os.Stdout)
+		if err != nil {
+			logger.Errorf("couldn't print config: %s", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "healthcheck":
+		err = healthcheck(fmt.Sprintf("http://localhost:%d/readyz", cfg.App.Port))
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	default:
+		if flag.Arg(0) == "keygen" {
+			err = keygen(cfg, flag.Args()[1:], os.Stdout)
+			if err != nil {
+				logger.Errorf("couldn't generate keys: %s", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err = cfg.validate()
 	if err != nil {
-		logger.Errorf("err decoding JSON in config: %s", err)
+		logger.Error(err)
 		os.Exit(1)
 	}
 
 	spotshot.RegisterGobEncodings()
 
-	// Setup Spotify authenticator.
-	spotAuth := spotify.NewAuthenticator(cfg.Spotify.RedirectURI,
+	// Setup Spotify authenticator. The client secret is optional since
+	// logins use PKCE.
+	spotAuth := spotshot.NewAuthenticator(cfg.Spotify.RedirectURI,
+		cfg.Spotify.ClientID,
+		cfg.Spotify.ClientSecret,
 		spotify.ScopeUserTopRead,
 		spotify.ScopePlaylistModifyPrivate,
-		spotify.ScopePlaylistModifyPublic)
-	spotAuth.SetAuthInfo(cfg.Spotify.ClientID, cfg.Spotify.ClientSecret)
+		spotify.ScopePlaylistModifyPublic,
+		spotify.ScopeImageUpload)
 
-	// Setup session store.
-	authKey, err := ioutil.ReadFile(cfg.App.SessionAuthenticationKeyFilename)
+	// Setup session store. Previous keys are kept after rotation so existing
+	// sessions stay valid.
+	sessionKeys, err := readSessionKeys(cfg)
 	if err != nil {
-		logger.Errorf("err reading session authentication key: %s", err)
+		logger.Error(err)
 		os.Exit(1)
 	}
-	encKey, err := ioutil.ReadFile(cfg.App.SessionEncryptionKeyFilename)
+	if len(sessionKeys) > 2 {
+		logger.Info("accepting sessions made with previous session keys")
+	}
+
+	// Setup Redis client. It's also used as the session store.
+	addrs := cfg.Redis.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{cfg.Redis.Addr}
+	}
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      addrs,
+		MasterName: cfg.Redis.MasterName,
+	})
+	defer redisClient.Close()
+	err = redisClient.Ping().Err()
 	if err != nil {
-		logger.Errorf("err reading session encryption key: %s", err)
+		logger.Errorf("error connecting to redis: %s", err)
 		os.Exit(1)
 	}
-	store, err := redistore.NewRediStore(10, "tcp", cfg.Redis.Addr, "", authKey, encKey)
+	err = spotshot.SyncSubscribers(redisClient)
 	if err != nil {
-		logger.Errorf("couldn't setup redis session store: %s", err)
-		os.Exit(1)
+		logger.Errorf("couldn't sync subscribers: %s", err)
+	}
+	store := spotshot.NewRedisStore(redisClient, sessionKeys...)
+	if cfg.Redis.SessionKeyPrefix != "" {
+		store.KeyPrefix = cfg.Redis.SessionKeyPrefix
 	}
-	defer store.Close()
 
-	// Setup Redis client.
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: cfg.Redis.Addr,
-	})
-	err = redisClient.Ping().Err()
+	// One-off playlist jobs are queued so requests don't wait on the creator.
+	playlistNowCh := make(chan spotshot.PlaylistJob, 100)
+	// Pick up jobs that were still queued when the app last shut down.
+	n, err := spotshot.RestorePendingJobs(redisClient, playlistNowCh, logger)
 	if err != nil {
-		logger.Errorf("error connecting to redis: %s", err)
+		logger.Errorf("couldn't restore queued playlist jobs: %s", err)
+	}
+	if n > 0 {
+		logger.Infof("restored %d queued playlist jobs", n)
+	}
+	err = spotshot.RegisterMetrics(prometheus.DefaultRegisterer, redisClient, playlistNowCh)
+	if err != nil {
+		logger.Errorf("couldn't register metrics: %s", err)
 		os.Exit(1)
 	}
+	// Let users know about their playlists.
+	webhookSender := spotshot.NewWebhookSender(redisClient, logger)
+	notifiers := spotshot.Notifiers{webhookSender}
+	var mailer *spotshot.Mailer
+	if cfg.SMTP.Addr != "" {
+		mailer = spotshot.NewMailer(cfg.SMTP.Addr, cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.From, cfg.App.BaseURL, redisClient, logger)
+		notifiers = append(notifiers, mailer)
+	}
 
-	playlistNowCh := make(chan spotify.ID)
-	go spotshot.PlaylistCreator(context.Background(), redisClient, logger, spotshot.SpotifyClientCreator(spotAuth), playlistNowCh)
+	creatorStatus := new(spotshot.CreatorStatus)
+	creatorCtx, stopCreator := context.WithCancel(context.Background())
+	creatorDone := make(chan struct{})
+	go func() {
+		spotshot.PlaylistCreator(creatorCtx, redisClient, logger, spotshot.SpotifyClientCreator(spotAuth), playlistNowCh, creatorStatus, notifiers)
+		close(creatorDone)
+	}()
+	webhooksDone := make(chan struct{})
+	go func() {
+		webhookSender.Run(creatorCtx)
+		close(webhooksDone)
+	}()
+	mailerDone := make(chan struct{})
+	go func() {
+		if mailer != nil {
+			mailer.Run(creatorCtx)
+		}
+		close(mailerDone)
+	}()
 
 	homeTmpl, err := template.ParseFiles("templates/index.html.tmpl")
 	if err != nil {
@@ -118,6 +202,57 @@ func main() {
 		os.Exit(1)
 	}
 
+	errTmpl, err := template.ParseFiles("templates/error.html.tmpl")
+	if err != nil {
+		logger.Errorf("error reading error template: %s", err)
+		os.Exit(1)
+	}
+	tokensTmpl, err := template.ParseFiles("templates/tokens.html.tmpl")
+	if err != nil {
+		logger.Errorf("error reading tokens template: %s", err)
+		os.Exit(1)
+	}
+	adminTmpl, err := template.ParseFiles("templates/admin.html.tmpl")
+	if err != nil {
+		logger.Errorf("error reading admin template: %s", err)
+		os.Exit(1)
+	}
+	settingsTmpl, err := template.ParseFiles("templates/settings.html.tmpl")
+	if err != nil {
+		logger.Errorf("error reading settings template: %s", err)
+		os.Exit(1)
+	}
+	publicTmpl, err := template.ParseFiles("templates/public.html.tmpl")
+	if err != nil {
+		logger.Errorf("error reading public template: %s", err)
+		os.Exit(1)
+	}
+	reviewTmpl, err := template.ParseFiles("templates/review.html.tmpl")
+	if err != nil {
+		logger.Errorf("error reading review template: %s", err)
+		os.Exit(1)
+	}
+	statsTmpl, err := template.ParseFiles("templates/stats.html.tmpl")
+	if err != nil {
+		logger.Errorf("error reading stats template: %s", err)
+		os.Exit(1)
+	}
+	diffTmpl, err := template.ParseFiles("templates/diff.html.tmpl")
+	if err != nil {
+		logger.Errorf("error reading diff template: %s", err)
+		os.Exit(1)
+	}
+	emailTmpl, err := template.ParseFiles("templates/email.html.tmpl")
+	if err != nil {
+		logger.Errorf("error reading email template: %s", err)
+		os.Exit(1)
+	}
+	shareCardLogo, err := spotshot.LoadShareCardLogo("static/img/android-chrome-192x192.png")
+	if err != nil {
+		logger.Errorf("error reading share card logo: %s", err)
+		os.Exit(1)
+	}
+
 	csrfAuthKey, err := ioutil.ReadFile(cfg.App.CSRFAuthenticationKeyFilename)
 	if err != nil {
 		logger.Errorf("err reading CSRF authentication key: %s", err)
@@ -131,31 +266,249 @@ func main() {
 
 	r := mux.NewRouter()
 	r.Path("/").Methods("GET").Handler(&spotshot.Endpoint{
-		HandlerFunc: spotshot.Home(homeTmpl, store, logger),
+		HandlerFunc: spotshot.Home(homeTmpl, store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
 		Logger:      logger})
 	r.Path("/login").Methods("POST").Handler(&spotshot.Endpoint{
 		HandlerFunc: spotshot.SpotifyLogin(spotAuth, store, logger),
+		ErrorTmpl:   errTmpl,
 		Logger:      logger})
 	r.Path("/logout").Methods("POST").Handler(&spotshot.Endpoint{
 		HandlerFunc: spotshot.Logout(store, logger),
+		ErrorTmpl:   errTmpl,
 		Logger:      logger})
 	r.Path("/callback").Methods("GET").Handler(&spotshot.Endpoint{
-		HandlerFunc: spotshot.Callback(spotAuth, store, redisClient, logger),
+		HandlerFunc: spotshot.Callback(spotAuth, store, redisClient, notifiers, logger),
+		ErrorTmpl:   errTmpl,
 		Logger:      logger})
 	r.Path("/subscribe").Methods("POST").Handler(&spotshot.Endpoint{
-		HandlerFunc: spotshot.Subscribe(store, redisClient, playlistNowCh, logger),
+		HandlerFunc: spotshot.Subscribe(store, redisClient, playlistNowCh, notifiers, logger),
+		ErrorTmpl:   errTmpl,
 		Logger:      logger})
 	r.Path("/unsubscribe").Methods("POST").Handler(&spotshot.Endpoint{
-		HandlerFunc: spotshot.Unsubscribe(store, redisClient, logger),
+		HandlerFunc: spotshot.Unsubscribe(store, redisClient, notifiers, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/export").Methods("GET").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.ExportData(store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/delete").Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.DeleteData(store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/tokens").Methods("GET").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.Tokens(tokensTmpl, store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/tokens").Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.CreateToken(tokensTmpl, store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/tokens/revoke").Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.RevokeToken(store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/settings").Methods("GET").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.Settings(settingsTmpl, store, redisClient, mailer, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/settings/email").Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.SetEmail(store, redisClient, mailer, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/settings/webhooks").Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.CreateWebhook(store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/settings/webhooks/delete").Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.DeleteWebhook(store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
 		Logger:      logger})
+	r.Path("/settings/feed").Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.SetFeed(store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/feed").Methods("GET").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.Feed(redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/review").Methods("GET").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.Review(reviewTmpl, store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/stats").Methods("GET").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.Stats(statsTmpl, store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/diff").Methods("GET").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.Diff(diffTmpl, store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/diff/playlist").Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.DiffPlaylist(store, redisClient, playlistNowCh, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/settings/public").Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.SetPublicPage(store, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/u/{handle}/{period}").Methods("GET").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.PublicSnapshot(publicTmpl, redisClient, cfg.App.BaseURL, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/u/{handle}/{period}/card.png").Methods("GET").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.ShareCard(redisClient, shareCardLogo, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/email/confirm").Methods("GET").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.ConfirmEmailPage(emailTmpl, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/email/confirm").Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.ConfirmEmail(errTmpl, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path(spotshot.EmailUnsubscribePath).Methods("GET").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.UnsubscribeEmailPage(emailTmpl, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path(spotshot.EmailUnsubscribePath).Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.UnsubscribeEmail(errTmpl, redisClient, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/admin").Methods("GET").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.Admin(adminTmpl, store, redisClient, cfg.App.AdminUserIDs, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/admin/run").Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.AdminRun(store, redisClient, playlistNowCh, cfg.App.AdminUserIDs, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+	r.Path("/admin/pause").Methods("POST").Handler(&spotshot.Endpoint{
+		HandlerFunc: spotshot.AdminPause(store, redisClient, cfg.App.AdminUserIDs, logger),
+		ErrorTmpl:   errTmpl,
+		Logger:      logger})
+
+	api := r.PathPrefix(apiPrefix).Subrouter()
+	api.Path("/subscription").Methods("GET").Handler(&spotshot.APIEndpoint{
+		APIHandlerFunc: spotshot.APIGetSubscription(redisClient),
+		Scope:          spotshot.ScopeRead,
+		Store:          store,
+		Logger:         logger})
+	api.Path("/subscription").Methods("PUT").Handler(&spotshot.APIEndpoint{
+		APIHandlerFunc: spotshot.APIPutSubscription(redisClient, notifiers, logger),
+		Scope:          spotshot.ScopeWrite,
+		Store:          store,
+		Logger:         logger})
+	api.Path("/subscription").Methods("DELETE").Handler(&spotshot.APIEndpoint{
+		APIHandlerFunc: spotshot.APIDeleteSubscription(redisClient, notifiers, logger),
+		Scope:          spotshot.ScopeWrite,
+		Store:          store,
+		Logger:         logger})
+	api.Path("/snapshots").Methods("GET").Handler(&spotshot.APIEndpoint{
+		APIHandlerFunc: spotshot.APIListSnapshots(redisClient),
+		Scope:          spotshot.ScopeRead,
+		Store:          store,
+		Logger:         logger})
+	api.Path("/snapshots").Methods("POST").Handler(&spotshot.APIEndpoint{
+		APIHandlerFunc: spotshot.APICreateSnapshot(redisClient, playlistNowCh),
+		Scope:          spotshot.ScopeTrigger,
+		Store:          store,
+		Logger:         logger})
+	api.Path("/diff").Methods("GET").Handler(&spotshot.APIEndpoint{
+		APIHandlerFunc: spotshot.APIGetDiff(redisClient),
+		Scope:          spotshot.ScopeRead,
+		Store:          store,
+		Logger:         logger})
+	api.Path("/diff/playlist").Methods("POST").Handler(&spotshot.APIEndpoint{
+		APIHandlerFunc: spotshot.APICreateDiffPlaylist(redisClient, playlistNowCh),
+		Scope:          spotshot.ScopeTrigger,
+		Store:          store,
+		Logger:         logger})
+
+	r.Path("/healthz").Methods("GET").Handler(spotshot.Healthz())
+	r.Path("/readyz").Methods("GET").Handler(spotshot.Readyz(redisClient,
+		[]*template.Template{homeTmpl, errTmpl, tokensTmpl, adminTmpl, settingsTmpl, publicTmpl, reviewTmpl, statsTmpl, diffTmpl, emailTmpl}, creatorStatus))
 	r.PathPrefix("/static/").Methods("GET").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	// Token authentication goes before CSRF protection so API requests using
+	// tokens can skip CSRF checks, as can one-click unsubscribes from emails.
+	// Other routes always get checked.
+	r.Use(spotshot.InstrumentHTTP)
+	r.Use(spotshot.RequestLogging(logger))
+	r.Use(spotshot.RenewSessions(store, logger))
+	r.Use(spotshot.TokenAuth(redisClient, apiPrefix, logger))
+	r.Use(spotshot.SkipEmailCSRF)
 	r.Use(csrf.Protect(csrfAuthKey))
 	s.Handler = r
 
+	// Metrics get their own listener so they aren't public.
+	var metricsServer *http.Server
+	if cfg.App.MetricsPort != 0 {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		metricsServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.App.MetricsPort),
+			Handler: metricsMux,
+		}
+		go func() {
+			logger.Infof("Metrics server running on port %d", cfg.App.MetricsPort)
+			err := metricsServer.ListenAndServe()
+			if err != http.ErrServerClosed {
+				logger.Errorf("metrics server unexpectedly closed: %s", err)
+			}
+		}()
+	}
+
+	// Shut down gracefully on SIGINT or SIGTERM, e.g. from docker stop, so
+	// playlists aren't left half made.
+	shutdownDone := make(chan struct{})
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigCh
+		logger.Infof("received %s, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := s.Shutdown(ctx)
+		if err != nil {
+			logger.Errorf("couldn't shut down server: %s", err)
+		}
+		if metricsServer != nil {
+			err = metricsServer.Shutdown(ctx)
+			if err != nil {
+				logger.Errorf("couldn't shut down metrics server: %s", err)
+			}
+		}
+		// Wait for the creator to finish the playlist it's making, and for
+		// webhooks and emails being sent.
+		stopCreator()
+		for name, done := range map[string]chan struct{}{"playlist creator": creatorDone, "webhook sender": webhooksDone, "mailer": mailerDone} {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				logger.Errorf("%s didn't stop in time", name)
+			}
+		}
+		// Save jobs that are still queued to run when the app starts again.
+		n, err := spotshot.SavePendingJobs(redisClient, playlistNowCh)
+		if err != nil {
+			logger.Errorf("couldn't save queued playlist jobs, %d were dropped: %s", len(playlistNowCh), err)
+		}
+		if n > 0 {
+			logger.Infof("saved %d queued playlist jobs", n)
+		}
+		close(shutdownDone)
+	}()
+
 	logger.Infof("Server running on port %d", cfg.App.Port)
-	err = s.ListenAndServe() // Should never go past this.
+	err = s.ListenAndServe()
 	if err != http.ErrServerClosed {
 		logger.Errorf("server unexpectedly closed: %s", err)
 		os.Exit(1)
 	}
+	<-shutdownDone
+	// Redis is closed by the deferred call.
+	logger.Info("shut down")
 }
@@ -0,0 +1,240 @@
+package spotshot
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+)
+
+// maxAdminJobs is how many of the most recent jobs are shown to admins.
+const maxAdminJobs = 50
+
+// UserJob is a job along with the user it was for.
+type UserJob struct {
+	UserID string
+	Job
+}
+
+// AdminOverview is the state of Spotshot shown to admins.
+type AdminOverview struct {
+	Subscribers int
+	Paused      bool
+	// LastRun is the month of the last finished monthly run, e.g. "2019-09".
+	LastRun    string
+	RecentJobs []UserJob
+	// Failing are subscribed users whose last job failed, with that job.
+	Failing     []UserJob
+	NeedsReauth []string
+}
+
+// getAdminOverview gathers up what admins need to know from every user.
+func getAdminOverview(redisClient redis.UniversalClient) (*AdminOverview, error) {
+	o := new(AdminOverview)
+	lastRun, err := redisClient.Get(RedisLastRunKey).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", RedisLastRunKey, err)
+	}
+	o.LastRun = lastRun
+	paused, err := redisClient.Exists(RedisPausedKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", RedisPausedKey, err)
+	}
+	o.Paused = paused > 0
+
+	o.Subscribers, err = countSubscribers(redisClient)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each user's settings and jobs are fetched in batches, rather than a
+	// round trip or two for every user.
+	keys, err := scanKeys(redisClient, fmt.Sprintf("%s:*", RedisUserIDKey))
+	if err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(keys); start += scanBatchSize {
+		batch := keys[start:]
+		if len(batch) > scanBatchSize {
+			batch = batch[:scanBatchSize]
+		}
+		err = addAdminUsers(redisClient, o, batch)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(o.RecentJobs, func(i, j int) bool {
+		return o.RecentJobs[i].StartedAt.After(o.RecentJobs[j].StartedAt)
+	})
+	if len(o.RecentJobs) > maxAdminJobs {
+		o.RecentJobs = o.RecentJobs[:maxAdminJobs]
+	}
+	sort.Slice(o.Failing, func(i, j int) bool {
+		return o.Failing[i].StartedAt.After(o.Failing[j].StartedAt)
+	})
+	sort.Strings(o.NeedsReauth)
+	return o, nil
+}
+
+// addAdminUsers adds the reauth state and jobs of the users with the keys to
+// the overview, with one pipeline for all of them.
+func addAdminUsers(redisClient redis.UniversalClient, o *AdminOverview, keys []string) error {
+	fieldCmds := make([]*redis.SliceCmd, len(keys))
+	jobCmds := make([]*redis.StringSliceCmd, len(keys))
+	_, err := redisClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			userID := strings.Split(key, ":")[1]
+			fieldCmds[i] = pipe.HMGet(key, NumSongsField, NeedsReauthField)
+			jobCmds[i] = pipe.LRange(fmt.Sprintf("%s:%s", RedisJobsKey, userID), 0, -1)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("couldn't get users: %w", err)
+	}
+	for i, key := range keys {
+		userID := strings.Split(key, ":")[1]
+		fields := fieldCmds[i].Val()
+		subscribed, needsReauth := fields[0] != nil, fields[1] != nil
+		if needsReauth {
+			o.NeedsReauth = append(o.NeedsReauth, userID)
+		}
+		jobs, err := decodeJobs(jobCmds[i].Val())
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			o.RecentJobs = append(o.RecentJobs, UserJob{userID, job})
+		}
+		if len(jobs) > 0 && jobs[0].Err != "" && subscribed {
+			o.Failing = append(o.Failing, UserJob{userID, jobs[0]})
+		}
+	}
+	return nil
+}
+
+// adminUserID returns the ID of the logged in user, as long as they're an admin.
+func adminUserID(r *http.Request, store sessions.Store, adminIDs []string, logger logrus.FieldLogger) (string, logrus.FieldLogger, error) {
+	// Fetch session.
+	session, err := store.Get(r, SessionName)
+	if err != nil {
+		logger.Warn(SessionFetchError{err})
+	}
+	if !isLoggedIn(session) {
+		return "", logger, ErrNotLoggedIn
+	}
+	// Get user ID from session.
+	userID, err := sessionUserID(session)
+	if err != nil {
+		return "", logger, err
+	}
+	logger = setRequestUser(r, logger, userID)
+	for _, id := range adminIDs {
+		if id == userID {
+			return userID, logger, nil
+		}
+	}
+	return "", logger, ErrNotAdmin
+}
+
+// Admin shows admins an overview of subscribers and jobs, along with controls
+// for the scheduler.
+func Admin(adminTmpl *template.Template, store sessions.Store, redisClient redis.UniversalClient, adminIDs []string, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		_, _, err := adminUserID(r, store, adminIDs, logger)
+		if err != nil {
+			return err
+		}
+		overview, err := getAdminOverview(redisClient)
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusOK)
+		return adminTmpl.Execute(w, map[string]interface{}{
+			"Overview":  overview,
+			"CSRFField": csrf.TemplateField(r),
+		})
+	}
+}
+
+// AdminRun makes the monthly playlist for the user given by the user_id form
+// value, or starts the monthly run for everyone if it's empty. Users that
+// already have this month's playlist are skipped.
+func AdminRun(store sessions.Store, redisClient redis.UniversalClient, playlistNowCh chan<- PlaylistJob, adminIDs []string, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		_, logger, err := adminUserID(r, store, adminIDs, logger)
+		if err != nil {
+			return err
+		}
+
+		userID := strings.TrimSpace(r.FormValue("user_id"))
+		if userID == "" {
+			// Make it look like the last run was last month, so the creator
+			// starts a new one.
+			err = redisClient.Set(RedisLastRunKey, monthlyPeriod(timeNow()), 0).Err()
+			if err != nil {
+				return fmt.Errorf("error while setting redis key %s: %w", RedisLastRunKey, err)
+			}
+			logger.Info("admin started monthly run")
+		} else {
+			exists, err := redisClient.Exists(fmt.Sprintf("%s:%s", RedisUserIDKey, userID)).Result()
+			if err != nil {
+				return fmt.Errorf("couldn't check user exists: %w", err)
+			}
+			if exists == 0 {
+				return InvalidValueError{"user_id", userID}
+			}
+			err = queuePlaylistJob(redisClient, playlistNowCh, PlaylistJob{UserID: spotify.ID(userID), Monthly: true, RequestID: RequestID(r)})
+			if err != nil {
+				return err
+			}
+			logger.WithField("target_user_id", userID).Info("admin queued monthly playlist")
+		}
+
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return nil
+	}
+}
+
+// AdminPause pauses or resumes monthly runs, depending on the paused form
+// value. A paused run carries on from where it stopped once resumed.
+func AdminPause(store sessions.Store, redisClient redis.UniversalClient, adminIDs []string, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		_, logger, err := adminUserID(r, store, adminIDs, logger)
+		if err != nil {
+			return err
+		}
+
+		switch paused := r.FormValue("paused"); paused {
+		case "true":
+			err = redisClient.Set(RedisPausedKey, timeNow().Unix(), 0).Err()
+			if err != nil {
+				return fmt.Errorf("error while setting redis key %s: %w", RedisPausedKey, err)
+			}
+			logger.Info("admin paused scheduler")
+		case "false":
+			err = redisClient.Del(RedisPausedKey).Err()
+			if err != nil {
+				return fmt.Errorf("couldn't delete redis key %s: %w", RedisPausedKey, err)
+			}
+			logger.Info("admin resumed scheduler")
+		case "":
+			return ExpectedFormValueError{"paused"}
+		default:
+			return InvalidValueError{"paused", paused}
+		}
+
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return nil
+	}
+}
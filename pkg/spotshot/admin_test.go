@@ -0,0 +1,130 @@
+package spotshot
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAdminScheduler(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	RegisterGobEncodings()
+	store := sessions.NewCookieStore([]byte("authentication-key"))
+	adminIDs := []string{"admin"}
+	s.Set(RedisLastRunKey, timeNow().Format("2006-01"))
+	form := "application/x-www-form-urlencoded"
+
+	// Only admins are allowed in.
+	r := loggedInRequest(t, store, "POST", "/admin/pause", "paused=true", "coolkid99")
+	r.Header.Set("Content-Type", form)
+	err = AdminPause(store, redisClient, adminIDs, logger)(httptest.NewRecorder(), r)
+	if !errors.Is(err, ErrNotAdmin) {
+		t.Fatalf("expected %s, got %v", ErrNotAdmin, err)
+	}
+
+	r = loggedInRequest(t, store, "POST", "/admin/pause", "paused=true", "admin")
+	r.Header.Set("Content-Type", form)
+	err = AdminPause(store, redisClient, adminIDs, logger)(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Starting a run while paused shouldn't do anything until resumed.
+	r = loggedInRequest(t, store, "POST", "/admin/run", "user_id=", "admin")
+	r.Header.Set("Content-Type", form)
+	err = AdminRun(store, redisClient, make(chan PlaylistJob, 1), adminIDs, logger)(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if due, err := monthlyRunDue(redisClient); err != nil || due {
+		t.Errorf("expected run not to be due while paused, got %v %v", due, err)
+	}
+
+	r = loggedInRequest(t, store, "POST", "/admin/pause", "paused=false", "admin")
+	r.Header.Set("Content-Type", form)
+	err = AdminPause(store, redisClient, adminIDs, logger)(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if due, err := monthlyRunDue(redisClient); err != nil || !due {
+		t.Errorf("expected run to be due once resumed, got %v %v", due, err)
+	}
+
+	// Runs for a single user are queued.
+	s.HSet(fmt.Sprintf("%s:%s", RedisUserIDKey, "coolkid99"), NumSongsField, "10")
+	playlistNowCh := make(chan PlaylistJob, 1)
+	r = loggedInRequest(t, store, "POST", "/admin/run", "user_id=coolkid99", "admin")
+	r.Header.Set("Content-Type", form)
+	err = AdminRun(store, redisClient, playlistNowCh, adminIDs, logger)(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if job := <-playlistNowCh; job.UserID != "coolkid99" || !job.Monthly {
+		t.Errorf("expected monthly job for coolkid99, got %+v", job)
+	}
+}
+
+func TestAdminOverview(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	for _, user := range []string{"ok", "failing", "revoked"} {
+		err = subscribe(redisClient, user, 10, false)
+		if err != nil {
+			t.Fatalf("couldn't subscribe: %s", err)
+		}
+	}
+	// Users that have unsubscribed aren't failing, even if their last job did.
+	s.HSet(fmt.Sprintf("%s:%s", RedisUserIDKey, "gone"), RefreshTokenField, "test")
+	err = saveJob(redisClient, "gone", &Job{Type: "monthly", StartedAt: timeNow(), Err: "spotify is down"})
+	if err != nil {
+		t.Fatalf("couldn't save job: %s", err)
+	}
+	s.HSet(fmt.Sprintf("%s:%s", RedisUserIDKey, "revoked"), NeedsReauthField, "1")
+	err = saveJob(redisClient, "ok", &Job{Type: "monthly", StartedAt: timeNow()})
+	if err != nil {
+		t.Fatalf("couldn't save job: %s", err)
+	}
+	err = saveJob(redisClient, "failing", &Job{Type: "monthly", StartedAt: timeNow(), Err: "spotify is down"})
+	if err != nil {
+		t.Fatalf("couldn't save job: %s", err)
+	}
+
+	o, err := getAdminOverview(redisClient)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if o.Subscribers != 3 {
+		t.Errorf("expected 3 subscribers, got %d", o.Subscribers)
+	}
+	if len(o.RecentJobs) != 3 {
+		t.Errorf("expected 3 recent jobs, got %d", len(o.RecentJobs))
+	}
+	if len(o.Failing) != 1 || o.Failing[0].UserID != "failing" || o.Failing[0].Err != "spotify is down" {
+		t.Errorf("expected failing user, got %+v", o.Failing)
+	}
+	if len(o.NeedsReauth) != 1 || o.NeedsReauth[0] != "revoked" {
+		t.Errorf("expected revoked user to need reauth, got %v", o.NeedsReauth)
+	}
+}
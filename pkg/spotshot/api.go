@@ -0,0 +1,191 @@
+package spotshot
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+)
+
+// APIHandlerFunc handles a JSON API request made by the given user.
+type APIHandlerFunc func(w http.ResponseWriter, r *http.Request, userID string) error
+
+// APIEndpoint authenticates JSON API requests and writes any errors as JSON.
+// Requests are authenticated by an API token with the endpoint's scope, or
+// by the user's session.
+type APIEndpoint struct {
+	APIHandlerFunc
+	Scope  string
+	Store  sessions.Store
+	Logger logrus.FieldLogger
+}
+
+func (e *APIEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Browser clients need the CSRF token to make unsafe requests.
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	logger := RequestLogger(r, e.Logger)
+	userID, err := e.authenticate(r)
+	if err == nil {
+		logger = setRequestUser(r, logger, userID)
+		err = e.APIHandlerFunc(w, r, userID)
+	}
+	if err != nil {
+		writeAPIError(w, err, logger)
+	}
+}
+
+// authenticate returns the ID of the user making the request.
+func (e *APIEndpoint) authenticate(r *http.Request) (string, error) {
+	if token := apiTokenFromContext(r.Context()); token != nil {
+		if !token.HasScope(e.Scope) {
+			return "", InsufficientScopeError{e.Scope}
+		}
+		return token.UserID, nil
+	}
+	session, err := e.Store.Get(r, SessionName)
+	if err != nil {
+		RequestLogger(r, e.Logger).Warn(SessionFetchError{err})
+	}
+	if !isLoggedIn(session) {
+		return "", ErrNotLoggedIn
+	}
+	return sessionUserID(session)
+}
+
+// APIGetSubscription responds with the user's subscription settings.
+func APIGetSubscription(redisClient redis.UniversalClient) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, userID string) error {
+		sub, err := getSubscription(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, sub)
+	}
+}
+
+// APIPutSubscription subscribes the user or changes their subscription settings.
+func APIPutSubscription(redisClient redis.UniversalClient, notifier Notifier, logger logrus.FieldLogger) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, userID string) error {
+		logger := RequestLogger(r, logger)
+		var body struct {
+			NumSongs *int `json:"num_songs"`
+			Private  bool `json:"private"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			return MalformedBodyError{err}
+		}
+		if body.NumSongs == nil {
+			return ExpectedFormValueError{"num_songs"}
+		}
+
+		err = subscribe(redisClient, userID, *body.NumSongs, body.Private)
+		if err != nil {
+			return err
+		}
+		logger.Infof("subscribed")
+		notifySubscriptionChanged(notifier, redisClient, userID, logger)
+
+		sub, err := getSubscription(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, sub)
+	}
+}
+
+// APIDeleteSubscription unsubscribes the user.
+func APIDeleteSubscription(redisClient redis.UniversalClient, notifier Notifier, logger logrus.FieldLogger) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, userID string) error {
+		logger := RequestLogger(r, logger)
+		err := unsubscribe(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		logger.Infof("unsubscribed")
+		notifySubscriptionChanged(notifier, redisClient, userID, logger)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// APICreateSnapshot queues a one-off playlist for the user.
+func APICreateSnapshot(redisClient redis.UniversalClient, playlistNowCh chan<- PlaylistJob) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, userID string) error {
+		sub, err := getSubscription(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		if !sub.Subscribed {
+			return ErrNotSubscribed
+		}
+		err = queuePlaylistJob(redisClient, playlistNowCh, PlaylistJob{UserID: spotify.ID(userID), RequestID: RequestID(r)})
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusAccepted, map[string]bool{"queued": true})
+	}
+}
+
+// APIListSnapshots responds with the user's snapshot history, oldest first.
+func APIListSnapshots(redisClient redis.UniversalClient) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, userID string) error {
+		snapshots, err := Snapshots(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, map[string]interface{}{"snapshots": snapshots})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError responds with a JSON error whose status and code depend on the
+// type of error. Details of unexpected errors are only logged.
+func writeAPIError(w http.ResponseWriter, err error, logger logrus.FieldLogger) {
+	httpErr := classifyError(err)
+	logError(logger, httpErr, err)
+	writeJSON(w, httpErr.Status, map[string]interface{}{
+		"error": map[string]string{
+			"code":    httpErr.Code,
+			"message": httpErr.Message,
+		},
+	})
+}
+
+// APIGetDiff responds with what changed between the user's snapshots with the
+// from and to playlist IDs.
+func APIGetDiff(redisClient redis.UniversalClient) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, userID string) error {
+		diff, err := loadSnapshotDiff(redisClient, userID, spotify.ID(r.FormValue("from")), spotify.ID(r.FormValue("to")))
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, diff)
+	}
+}
+
+// APICreateDiffPlaylist queues a playlist of the tracks that are new in the
+// user's to snapshot since their from one.
+func APICreateDiffPlaylist(redisClient redis.UniversalClient, playlistNowCh chan<- PlaylistJob) APIHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, userID string) error {
+		from, to := spotify.ID(r.FormValue("from")), spotify.ID(r.FormValue("to"))
+		_, err := loadSnapshotDiff(redisClient, userID, from, to)
+		if err != nil {
+			return err
+		}
+		err = queuePlaylistJob(redisClient, playlistNowCh, PlaylistJob{UserID: spotify.ID(userID), ChangesFrom: from, ChangesTo: to, RequestID: RequestID(r)})
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusAccepted, map[string]bool{"queued": true})
+	}
+}
@@ -0,0 +1,104 @@
+package spotshot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+// loggedInRequest returns a request with a session cookie for the given user.
+func loggedInRequest(t *testing.T, store sessions.Store, method, target, body, userID string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	session, err := store.New(r, SessionName)
+	if err != nil {
+		t.Fatalf("couldn't create session: %s", err)
+	}
+	session.Values[IsLoggedIn] = true
+	session.Values[SpotifyUserID] = userID
+	w := httptest.NewRecorder()
+	err = session.Save(r, w)
+	if err != nil {
+		t.Fatalf("couldn't save session: %s", err)
+	}
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestAPISubscription(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	RegisterGobEncodings()
+	store := sessions.NewCookieStore([]byte("authentication-key"))
+
+	// Not logged in.
+	w := httptest.NewRecorder()
+	endpoint := &APIEndpoint{APIHandlerFunc: APIGetSubscription(redisClient), Store: store, Logger: logger}
+	endpoint.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/subscription", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	var errBody struct {
+		Error struct {
+			Code string
+		}
+	}
+	err = json.NewDecoder(w.Body).Decode(&errBody)
+	if err != nil || errBody.Error.Code != "not_logged_in" {
+		t.Errorf("expected not_logged_in error, got %v %+v", err, errBody)
+	}
+
+	// Invalid number of songs.
+	w = httptest.NewRecorder()
+	endpoint = &APIEndpoint{APIHandlerFunc: APIPutSubscription(redisClient, Notifiers(nil), logger), Store: store, Logger: logger}
+	endpoint.ServeHTTP(w, loggedInRequest(t, store, "PUT", "/api/v1/subscription", `{"num_songs": 0}`, "coolkid99"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Subscribe.
+	w = httptest.NewRecorder()
+	endpoint.ServeHTTP(w, loggedInRequest(t, store, "PUT", "/api/v1/subscription", `{"num_songs": 100, "private": true}`, "coolkid99"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var sub Subscription
+	err = json.NewDecoder(w.Body).Decode(&sub)
+	if err != nil {
+		t.Fatalf("couldn't decode subscription: %s", err)
+	}
+	if !sub.Subscribed || sub.NumSongs != MaxNumSongs || !sub.Private {
+		t.Errorf("expected private subscription with %d songs, got %+v", MaxNumSongs, sub)
+	}
+
+	// Unsubscribe, then a snapshot can't be made.
+	w = httptest.NewRecorder()
+	endpoint = &APIEndpoint{APIHandlerFunc: APIDeleteSubscription(redisClient, Notifiers(nil), logger), Store: store, Logger: logger}
+	endpoint.ServeHTTP(w, loggedInRequest(t, store, "DELETE", "/api/v1/subscription", "", "coolkid99"))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	w = httptest.NewRecorder()
+	endpoint = &APIEndpoint{APIHandlerFunc: APICreateSnapshot(redisClient, nil), Store: store, Logger: logger}
+	endpoint.ServeHTTP(w, loggedInRequest(t, store, "POST", "/api/v1/snapshots", "", "coolkid99"))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+}
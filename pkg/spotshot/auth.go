@@ -0,0 +1,98 @@
+package spotshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/zmb3/spotify"
+	"golang.org/x/oauth2"
+)
+
+// Authenticator runs the Spotify authorization code flow with PKCE. If no
+// client secret is given it acts as a public client, so the secret doesn't
+// need to be deployed with the app.
+type Authenticator struct {
+	// Authenticator is used to create Spotify clients, which refresh tokens themselves.
+	spotify.Authenticator
+	config *oauth2.Config
+	// ctx carries the HTTP client for token requests, which like the Spotify
+	// client's has HTTP/2 turned off.
+	ctx context.Context
+}
+
+// NewAuthenticator creates an Authenticator for the given redirect URI and scopes.
+func NewAuthenticator(redirectURI, clientID, clientSecret string, scopes ...string) Authenticator {
+	auth := spotify.NewAuthenticator(redirectURI, scopes...)
+	auth.SetAuthInfo(clientID, clientSecret)
+	config := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURI,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   spotify.AuthURL,
+			TokenURL:  spotify.TokenURL,
+			AuthStyle: oauth2.AuthStyleInHeader,
+		},
+	}
+	// Public clients identify themselves with just their client ID in the request body.
+	if clientSecret == "" {
+		config.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+	}}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	return Authenticator{auth, config, ctx}
+}
+
+// AuthURL returns the URL to send the user to so they can authorize us. The
+// code verifier must be kept secret and passed to Token once they return.
+func (a Authenticator) AuthURL(state, codeVerifier string) string {
+	return a.config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge(codeVerifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+}
+
+// Token exchanges the code in the callback request for a token. The request's
+// state must already have been checked.
+func (a Authenticator) Token(r *http.Request, codeVerifier string) (*oauth2.Token, error) {
+	values := r.URL.Query()
+	if e := values.Get("error"); e != "" {
+		return nil, SpotifyAuthError{e}
+	}
+	code := values.Get("code")
+	if code == "" {
+		return nil, SpotifyAuthError{"no access code"}
+	}
+	return a.config.Exchange(a.ctx, code,
+		oauth2.SetAuthURLParam("code_verifier", codeVerifier))
+}
+
+// NewClient makes a Spotify client for the token, refreshing it first if
+// it's expired. The embedded authenticator can only guess how to send our
+// credentials when refreshing, so it's done here with our config instead.
+// Clients are only used for one job, well within the hour an access token
+// lasts, so they don't need to refresh it again.
+func (a Authenticator) NewClient(token *oauth2.Token) (*spotify.Client, error) {
+	token, err := a.config.TokenSource(a.ctx, token).Token()
+	if err != nil {
+		return nil, err
+	}
+	client := a.Authenticator.NewClient(token)
+	return &client, nil
+}
+
+// newCodeVerifier returns a PKCE code verifier, which is 43 to 128 characters
+// from the URL-safe alphabet.
+func newCodeVerifier() (string, error) {
+	return randToken(64)
+}
+
+func codeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,133 @@
+package spotshot
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+func TestCodeChallenge(t *testing.T) {
+	// The challenge is the unpadded base64url SHA-256 of the verifier.
+	got := codeChallenge("dBjftJeZ4CVP-mJ92ZrqZ6VUhLW5kVrNmDnCtY1FZ6g")
+	want := "n6qtwbTFtHUfL738NUyYgUdtUZKEnpc6UD4k3DW9ApA"
+	if got != want {
+		t.Errorf("expected challenge %s, got %s", want, got)
+	}
+}
+
+func TestAuthURLHasCodeChallenge(t *testing.T) {
+	auth := NewAuthenticator("http://localhost/callback", "id", "")
+	u, err := url.Parse(auth.AuthURL("state", "verifier"))
+	if err != nil {
+		t.Fatalf("couldn't parse auth URL: %s", err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge") != codeChallenge("verifier") {
+		t.Errorf("expected code challenge %s, got %s", codeChallenge("verifier"), q.Get("code_challenge"))
+	}
+	if q.Get("code_challenge_method") != "S256" {
+		t.Errorf("expected code challenge method S256, got %s", q.Get("code_challenge_method"))
+	}
+	if q.Get("state") != "state" {
+		t.Errorf("expected state to be set, got %s", q.Get("state"))
+	}
+}
+
+func TestCallbackState(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	RegisterGobEncodings()
+	store := sessions.NewCookieStore([]byte("authentication-key"))
+	timeNow = func() time.Time { return time.Unix(1000, 0) }
+	defer func() { timeNow = time.Now }()
+
+	tests := []struct {
+		name   string
+		values map[interface{}]interface{}
+		query  string
+		err    error
+	}{
+		{"not set", map[interface{}]interface{}{}, "abc", ErrStateNotSet},
+		{"missing verifier", map[interface{}]interface{}{
+			SpotifyState: "abc", SpotifyStateExpiry: int64(2000),
+		}, "abc", ErrStateNotSet},
+		{"unexpected type", map[interface{}]interface{}{
+			SpotifyState: "abc", SpotifyStateExpiry: "2000", SpotifyCodeVerifier: "verifier",
+		}, "abc", ErrStateUnexpectedType},
+		{"expired", map[interface{}]interface{}{
+			SpotifyState: "abc", SpotifyStateExpiry: int64(999), SpotifyCodeVerifier: "verifier",
+		}, "abc", ErrStateExpired},
+		{"mismatch", map[interface{}]interface{}{
+			SpotifyState: "abc", SpotifyStateExpiry: int64(2000), SpotifyCodeVerifier: "verifier",
+		}, "abd", ErrStateMismatch},
+		{"missing from query", map[interface{}]interface{}{
+			SpotifyState: "abc", SpotifyStateExpiry: int64(2000), SpotifyCodeVerifier: "verifier",
+		}, "", ErrStateMismatch},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/callback?code=code&state="+test.query, nil)
+		session, err := store.New(r, SessionName)
+		if err != nil {
+			t.Fatalf("couldn't create session: %s", err)
+		}
+		for k, v := range test.values {
+			session.Values[k] = v
+		}
+		w := httptest.NewRecorder()
+		err = session.Save(r, w)
+		if err != nil {
+			t.Fatalf("couldn't save session: %s", err)
+		}
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+
+		w = httptest.NewRecorder()
+		err = Callback(Authenticator{}, store, nil, nil, logger)(w, r)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+		// Whatever happened, the state can't be used again.
+		r = httptest.NewRequest("GET", "/callback", nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		session, err = store.Get(r, SessionName)
+		if err != nil {
+			t.Fatalf("%s: couldn't get session: %s", test.name, err)
+		}
+		if _, ok := session.Values[SpotifyState]; ok {
+			t.Errorf("%s: expected state to be removed from the session", test.name)
+		}
+	}
+}
+
+func TestNewClientRefreshesPublicClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if _, _, ok := r.BasicAuth(); ok {
+			t.Errorf("expected no basic auth for a public client")
+		}
+		if r.PostForm.Get("client_id") != "id" || r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh" {
+			t.Errorf("unexpected refresh request %v", r.PostForm)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "access", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer ts.Close()
+	auth := NewAuthenticator("http://localhost/callback", "id", "")
+	auth.config.Endpoint.TokenURL = ts.URL
+
+	_, err := auth.NewClient(&oauth2.Token{RefreshToken: "refresh"})
+	if err != nil {
+		t.Fatalf("couldn't make client: %s", err)
+	}
+}
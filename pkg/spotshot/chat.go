@@ -0,0 +1,133 @@
+package spotshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// WebhookTypeDiscord webhooks post embeds to a Discord channel's incoming
+	// webhook.
+	WebhookTypeDiscord = "discord"
+	// WebhookTypeSlack webhooks post Block Kit messages to a Slack incoming
+	// webhook.
+	WebhookTypeSlack = "slack"
+
+	// chatTopTracks is how many of the top tracks are listed in chat messages.
+	chatTopTracks = 5
+	// spotifyGreen is the colour of the bar down the side of Discord embeds.
+	spotifyGreen = 0x1DB954
+)
+
+// chatEvents are the events sent to chat webhooks. Other events are only
+// useful to programs.
+var chatEvents = map[string]bool{
+	EventSnapshotCreated: true,
+}
+
+type discordMessage struct {
+	Username string         `json:"username"`
+	Content  string         `json:"content,omitempty"`
+	Embeds   []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string             `json:"title"`
+	URL         string             `json:"url"`
+	Description string             `json:"description"`
+	Color       int                `json:"color"`
+	Thumbnail   *discordEmbedImage `json:"thumbnail,omitempty"`
+	Footer      discordEmbedFooter `json:"footer"`
+	Timestamp   string             `json:"timestamp"`
+}
+
+type discordEmbedImage struct {
+	URL string `json:"url"`
+}
+
+type discordEmbedFooter struct {
+	Text string `json:"text"`
+}
+
+type slackMessage struct {
+	// Text is shown in notifications, where blocks can't be.
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type      string      `json:"type"`
+	Text      *slackText  `json:"text,omitempty"`
+	Elements  []slackText `json:"elements,omitempty"`
+	Accessory *slackImage `json:"accessory,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackImage struct {
+	Type     string `json:"type"`
+	ImageURL string `json:"image_url"`
+	AltText  string `json:"alt_text"`
+}
+
+var discordEscaper = strings.NewReplacer(
+	`\`, `\\`, `*`, `\*`, `_`, `\_`, "`", "\\`", `~`, `\~`, `|`, `\|`, `>`, `\>`, `[`, `\[`, `]`, `\]`,
+)
+
+// discordBody formats the event as a Discord embed.
+func discordBody(e *Event) ([]byte, error) {
+	s := e.Snapshot
+	var desc strings.Builder
+	for i, track := range topTracks(s, chatTopTracks) {
+		fmt.Fprintf(&desc, "%d. **%s** – %s\n", i+1, discordEscaper.Replace(track.Name), discordEscaper.Replace(track.ArtistNames()))
+	}
+	embed := discordEmbed{
+		Title:       s.Name,
+		URL:         s.PlaylistURL(),
+		Description: desc.String(),
+		Color:       spotifyGreen,
+		Footer:      discordEmbedFooter{Text: fmt.Sprintf("%d songs · Spotshot", len(s.Tracks))},
+		Timestamp:   s.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+	}
+	if cover := s.CoverURL(); cover != "" {
+		embed.Thumbnail = &discordEmbedImage{URL: cover}
+	}
+	return json.Marshal(discordMessage{
+		Username: "Spotshot",
+		Content:  "Your new playlist is ready!",
+		Embeds:   []discordEmbed{embed},
+	})
+}
+
+var slackEscaper = strings.NewReplacer(`&`, `&amp;`, `<`, `&lt;`, `>`, `&gt;`)
+
+// slackBody formats the event as a Slack Block Kit message.
+func slackBody(e *Event) ([]byte, error) {
+	s := e.Snapshot
+	var text strings.Builder
+	fmt.Fprintf(&text, "*<%s|%s>*\n", s.PlaylistURL(), slackEscaper.Replace(s.Name))
+	for i, track := range topTracks(s, chatTopTracks) {
+		fmt.Fprintf(&text, "%d. *%s* – %s\n", i+1, slackEscaper.Replace(track.Name), slackEscaper.Replace(track.ArtistNames()))
+	}
+	section := slackBlock{
+		Type: "section",
+		Text: &slackText{Type: "mrkdwn", Text: text.String()},
+	}
+	if cover := s.CoverURL(); cover != "" {
+		section.Accessory = &slackImage{Type: "image", ImageURL: cover, AltText: "Top track"}
+	}
+	return json.Marshal(slackMessage{
+		Text: fmt.Sprintf("Your new playlist %s is ready!", s.Name),
+		Blocks: []slackBlock{
+			section,
+			{
+				Type:     "context",
+				Elements: []slackText{{Type: "mrkdwn", Text: fmt.Sprintf("%d songs · Spotshot", len(s.Tracks))}},
+			},
+		},
+	})
+}
@@ -0,0 +1,122 @@
+package spotshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+)
+
+func TestChatWebhooks(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	user := "coolkid99"
+
+	bodies := make(map[string]chan []byte)
+	for _, webhookType := range []string{WebhookTypeDiscord, WebhookTypeSlack} {
+		ch := make(chan []byte, 10)
+		bodies[webhookType] = ch
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			ch <- body
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer ts.Close()
+		_, err = createWebhook(redisClient, user, ts.URL, webhookType)
+		if err != nil {
+			t.Fatalf("couldn't create %s webhook: %s", webhookType, err)
+		}
+	}
+	sender := newWebhookSender(redisClient, http.DefaultTransport, logrus.New())
+
+	snapshot := &Snapshot{Name: "Your Top Songs Aug 19", PlaylistID: "abc", CreatedAt: timeNow()}
+	for i := 1; i <= 6; i++ {
+		snapshot.Tracks = append(snapshot.Tracks, SnapshotTrack{
+			Name:     fmt.Sprintf("Song_%d", i),
+			Artists:  []SnapshotArtist{{Name: "Tom & Jerry"}},
+			ImageURL: fmt.Sprintf("https://i.scdn.co/image/%d", i),
+		})
+	}
+	err = sender.Notify(&Event{Type: EventSubscriptionChanged, UserID: user, Time: timeNow()})
+	if err != nil {
+		t.Fatalf("couldn't notify: %s", err)
+	}
+	err = sender.Notify(&Event{Type: EventSnapshotCreated, UserID: user, Time: timeNow(), Snapshot: snapshot})
+	if err != nil {
+		t.Fatalf("couldn't notify: %s", err)
+	}
+	queued, err := redisClient.ZRange(RedisWebhookQueueKey, 0, -1).Result()
+	if err != nil {
+		t.Fatalf("couldn't get queue: %s", err)
+	}
+	if len(queued) != 2 {
+		t.Fatalf("expected only the snapshot to be queued for each webhook, got %d deliveries", len(queued))
+	}
+	for _, member := range queued {
+		d := new(webhookDelivery)
+		err = json.Unmarshal([]byte(member), d)
+		if err != nil {
+			t.Fatalf("couldn't decode delivery: %s", err)
+		}
+		sender.deliver(d)
+	}
+
+	var discord discordMessage
+	err = json.Unmarshal(<-bodies[WebhookTypeDiscord], &discord)
+	if err != nil {
+		t.Fatalf("couldn't decode discord message: %s", err)
+	}
+	if len(discord.Embeds) != 1 {
+		t.Fatalf("expected 1 discord embed, got %d", len(discord.Embeds))
+	}
+	embed := discord.Embeds[0]
+	if embed.Title != snapshot.Name || embed.URL != "https://open.spotify.com/playlist/abc" {
+		t.Errorf("unexpected discord embed title or URL: %+v", embed)
+	}
+	if embed.Thumbnail == nil || embed.Thumbnail.URL != "https://i.scdn.co/image/1" {
+		t.Errorf("expected discord embed to have the top track's album art as its thumbnail, got %+v", embed.Thumbnail)
+	}
+	if !strings.Contains(embed.Description, `1. **Song\_1** – Tom & Jerry`) || strings.Contains(embed.Description, "Song\\_6") {
+		t.Errorf("expected discord embed to list the top %d songs, got:\n%s", chatTopTracks, embed.Description)
+	}
+
+	var slack slackMessage
+	err = json.Unmarshal(<-bodies[WebhookTypeSlack], &slack)
+	if err != nil {
+		t.Fatalf("couldn't decode slack message: %s", err)
+	}
+	if len(slack.Blocks) == 0 || slack.Blocks[0].Text == nil {
+		t.Fatalf("expected slack message to start with a section, got %+v", slack.Blocks)
+	}
+	section := slack.Blocks[0]
+	if section.Accessory == nil || section.Accessory.ImageURL != "https://i.scdn.co/image/1" || section.Accessory.AltText != "Top track" {
+		t.Errorf("expected slack section to have the top track's album art, got %+v", section.Accessory)
+	}
+	if !strings.Contains(section.Text.Text, "<https://open.spotify.com/playlist/abc|Your Top Songs Aug 19>") ||
+		!strings.Contains(section.Text.Text, "1. *Song_1* – Tom &amp; Jerry") || strings.Contains(section.Text.Text, "Song_6") {
+		t.Errorf("unexpected slack section text:\n%s", section.Text.Text)
+	}
+
+	entries, err := WebhookLog(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't get webhook log: %s", err)
+	}
+	for _, entry := range entries {
+		if entry.Err != "" {
+			t.Errorf("expected delivery to %s to succeed, got %s", entry.URL, entry.Err)
+		}
+	}
+}
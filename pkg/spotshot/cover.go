@@ -0,0 +1,96 @@
+package spotshot
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"strings"
+	"time"
+)
+
+const (
+	coverSize = 640
+	// maxCoverSize is the most Spotify accepts for a playlist image, after
+	// it's base64 encoded.
+	maxCoverSize = 256 << 10
+)
+
+// coverTheme is the colours of a user's playlist covers.
+type coverTheme struct {
+	background, text, accent color.RGBA
+}
+
+// coverThemes are picked from by user ID, so each user's covers look the
+// same every month.
+var coverThemes = []coverTheme{
+	{color.RGBA{0x1d, 0xb9, 0x54, 0xff}, color.RGBA{0x19, 0x14, 0x14, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff}},
+	{color.RGBA{0x19, 0x14, 0x14, 0xff}, color.RGBA{0x1d, 0xb9, 0x54, 0xff}, color.RGBA{0xb3, 0xb3, 0xb3, 0xff}},
+	{color.RGBA{0xe9, 0x1e, 0x63, 0xff}, color.RGBA{0xff, 0xf1, 0xf5, 0xff}, color.RGBA{0x33, 0x00, 0x14, 0xff}},
+	{color.RGBA{0x27, 0x85, 0xe8, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff}, color.RGBA{0x0b, 0x1f, 0x3a, 0xff}},
+	{color.RGBA{0xff, 0xc8, 0x62, 0xff}, color.RGBA{0x2b, 0x1a, 0x00, 0xff}, color.RGBA{0x8a, 0x4b, 0x00, 0xff}},
+	{color.RGBA{0x50, 0x9b, 0xf5, 0xff}, color.RGBA{0x14, 0x14, 0x3c, 0xff}, color.RGBA{0xf0, 0xf0, 0xff, 0xff}},
+	{color.RGBA{0xaf, 0x28, 0x96, 0xff}, color.RGBA{0xff, 0xe6, 0xf8, 0xff}, color.RGBA{0xf5, 0x9b, 0x23, 0xff}},
+	{color.RGBA{0xf0, 0x37, 0x4b, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff}, color.RGBA{0x50, 0x0a, 0x14, 0xff}},
+}
+
+func userCoverTheme(userID string) coverTheme {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return coverThemes[h.Sum32()%uint32(len(coverThemes))]
+}
+
+// coverText is the big and small text on the cover for the period, e.g.
+// "AUG" and "2019" for a monthly snapshot, "SEP" and "14 2019" for a
+// one-off one, or "2019" and "IN REVIEW" for a year in review.
+func coverText(period string) (string, string) {
+	if t, err := time.Parse("2006", period); err == nil {
+		return t.Format("2006"), "IN REVIEW"
+	}
+	if t, err := time.Parse("2006-01", period); err == nil {
+		return strings.ToUpper(t.Format("Jan")), t.Format("2006")
+	}
+	if t, err := time.Parse("2006-01-02", period); err == nil {
+		return strings.ToUpper(t.Format("Jan")), t.Format("2 2006")
+	}
+	return period, ""
+}
+
+// drawCentredText draws text centred across the image at the given height.
+func drawCentredText(dst draw.Image, text string, y, scale int, c color.Color) {
+	text = fitText(text, dst.Bounds().Dx(), scale)
+	width := len([]rune(text)) * shareCardFace.Advance * scale
+	drawText(dst, text, (dst.Bounds().Dx()-width)/2, y, scale, c)
+}
+
+// renderCover makes a JPEG playlist cover for the user's snapshot, small
+// enough for Spotify to accept.
+func renderCover(userID, period string) ([]byte, error) {
+	theme := userCoverTheme(userID)
+	img := image.NewRGBA(image.Rect(0, 0, coverSize, coverSize))
+	draw.Draw(img, img.Bounds(), image.NewUniform(theme.background), image.Point{}, draw.Src)
+	// Bars across the top and bottom.
+	draw.Draw(img, image.Rect(0, 0, coverSize, 24), image.NewUniform(theme.accent), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, coverSize-24, coverSize, coverSize), image.NewUniform(theme.accent), image.Point{}, draw.Src)
+
+	big, small := coverText(period)
+	drawCentredText(img, "TOP SONGS", 70, 5, theme.accent)
+	drawCentredText(img, big, 160, 20, theme.text)
+	drawCentredText(img, small, 440, 8, theme.text)
+
+	for quality := 90; quality > 0; quality -= 20 {
+		var b bytes.Buffer
+		err := jpeg.Encode(&b, img, &jpeg.Options{Quality: quality})
+		if err != nil {
+			return nil, err
+		}
+		if base64.StdEncoding.EncodedLen(b.Len()) <= maxCoverSize {
+			return b.Bytes(), nil
+		}
+	}
+	return nil, fmt.Errorf("cover is over %d bytes", maxCoverSize)
+}
@@ -0,0 +1,30 @@
+package spotshot
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/jpeg"
+	"testing"
+)
+
+func TestRenderCover(t *testing.T) {
+	for _, period := range []string{"2019-08", "2019-09-14"} {
+		b, err := renderCover("coolkid99", period)
+		if err != nil {
+			t.Fatalf("couldn't render cover for %s: %s", period, err)
+		}
+		if n := base64.StdEncoding.EncodedLen(len(b)); n > maxCoverSize {
+			t.Errorf("expected cover for %s to be at most %d bytes encoded, got %d", period, maxCoverSize, n)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("couldn't decode cover for %s: %s", period, err)
+		}
+		if b := img.Bounds(); b.Dx() != coverSize || b.Dy() != coverSize {
+			t.Errorf("expected %dx%d cover, got %dx%d", coverSize, coverSize, b.Dx(), b.Dy())
+		}
+	}
+	if userCoverTheme("coolkid99") != userCoverTheme("coolkid99") {
+		t.Errorf("expected a user to always get the same theme")
+	}
+}
@@ -0,0 +1,352 @@
+package spotshot
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+	"golang.org/x/oauth2"
+)
+
+// TrackChange is how a track's place changed between two snapshots.
+type TrackChange struct {
+	Track SnapshotTrack `json:"track"`
+	// FromRank and ToRank are the track's places in each snapshot, starting
+	// at 1, or 0 if it isn't in that snapshot.
+	FromRank int `json:"from_rank,omitempty"`
+	ToRank   int `json:"to_rank,omitempty"`
+	// Change is how many places the track moved up, or down if negative.
+	Change int `json:"change"`
+}
+
+// Places is how many places the track moved, up or down.
+func (c TrackChange) Places() int {
+	if c.Change < 0 {
+		return -c.Change
+	}
+	return c.Change
+}
+
+// SnapshotDiff is what changed between two of a user's snapshots.
+type SnapshotDiff struct {
+	// From and To are the playlist IDs of the snapshots compared.
+	From       spotify.ID `json:"from"`
+	To         spotify.ID `json:"to"`
+	FromPeriod string     `json:"from_period"`
+	ToPeriod   string     `json:"to_period"`
+	// Added are tracks only in the To snapshot and Removed are only in the
+	// From one. Moved are in both, in their order in the To snapshot.
+	Added          []TrackChange `json:"added"`
+	Removed        []TrackChange `json:"removed"`
+	Moved          []TrackChange `json:"moved"`
+	ArtistsEntered []string      `json:"artists_entered"`
+	ArtistsLeft    []string      `json:"artists_left"`
+}
+
+// ChangesPlaylist is a playlist of the tracks in one of the user's snapshots
+// that weren't in another.
+type ChangesPlaylist struct {
+	PlaylistID spotify.ID `json:"playlist_id"`
+	Name       string     `json:"name"`
+	Private    bool       `json:"private"`
+	// From and To are the playlist IDs of the snapshots compared.
+	From      spotify.ID      `json:"from"`
+	To        spotify.ID      `json:"to"`
+	CreatedAt time.Time       `json:"created_at"`
+	Tracks    []SnapshotTrack `json:"tracks"`
+}
+
+// findSnapshot returns the snapshot with the playlist ID, or nil if there
+// isn't one. Snapshots are found by playlist rather than period, since
+// one-offs made on the same day share a period.
+func findSnapshot(snapshots []Snapshot, playlistID spotify.ID) *Snapshot {
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if snapshots[i].PlaylistID == playlistID {
+			return &snapshots[i]
+		}
+	}
+	return nil
+}
+
+// artistNames lists the artists of the tracks in order of first appearance.
+func artistNames(tracks []SnapshotTrack) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, track := range tracks {
+		for _, artist := range track.Artists {
+			if !seen[artist.Name] {
+				seen[artist.Name] = true
+				names = append(names, artist.Name)
+			}
+		}
+	}
+	return names
+}
+
+// newSnapshotDiff compares two snapshots.
+func newSnapshotDiff(from, to *Snapshot) *SnapshotDiff {
+	diff := &SnapshotDiff{
+		From:           from.PlaylistID,
+		To:             to.PlaylistID,
+		FromPeriod:     from.Period,
+		ToPeriod:       to.Period,
+		Added:          make([]TrackChange, 0),
+		Removed:        make([]TrackChange, 0),
+		Moved:          make([]TrackChange, 0),
+		ArtistsEntered: make([]string, 0),
+		ArtistsLeft:    make([]string, 0),
+	}
+	fromRanks := make(map[spotify.ID]int)
+	for i, track := range from.Tracks {
+		if fromRanks[track.ID] == 0 {
+			fromRanks[track.ID] = i + 1
+		}
+	}
+	toRanks := make(map[spotify.ID]int)
+	for i, track := range to.Tracks {
+		if toRanks[track.ID] != 0 {
+			continue
+		}
+		toRanks[track.ID] = i + 1
+		change := TrackChange{Track: track, FromRank: fromRanks[track.ID], ToRank: i + 1}
+		if change.FromRank == 0 {
+			diff.Added = append(diff.Added, change)
+			continue
+		}
+		change.Change = change.FromRank - change.ToRank
+		diff.Moved = append(diff.Moved, change)
+	}
+	for i, track := range from.Tracks {
+		if toRanks[track.ID] == 0 && fromRanks[track.ID] == i+1 {
+			diff.Removed = append(diff.Removed, TrackChange{Track: track, FromRank: i + 1})
+		}
+	}
+
+	fromArtists, toArtists := artistNames(from.Tracks), artistNames(to.Tracks)
+	inFrom := make(map[string]bool)
+	for _, name := range fromArtists {
+		inFrom[name] = true
+	}
+	inTo := make(map[string]bool)
+	for _, name := range toArtists {
+		inTo[name] = true
+		if !inFrom[name] {
+			diff.ArtistsEntered = append(diff.ArtistsEntered, name)
+		}
+	}
+	for _, name := range fromArtists {
+		if !inTo[name] {
+			diff.ArtistsLeft = append(diff.ArtistsLeft, name)
+		}
+	}
+	return diff
+}
+
+// loadSnapshotDiff compares the user's snapshots with the two playlist IDs.
+func loadSnapshotDiff(redisClient redis.UniversalClient, userID string, from, to spotify.ID) (*SnapshotDiff, error) {
+	if from == "" {
+		return nil, ExpectedFormValueError{"from"}
+	}
+	if to == "" {
+		return nil, ExpectedFormValueError{"to"}
+	}
+	snapshots, err := Snapshots(redisClient, userID)
+	if err != nil {
+		return nil, err
+	}
+	fromSnapshot, toSnapshot := findSnapshot(snapshots, from), findSnapshot(snapshots, to)
+	if fromSnapshot == nil || toSnapshot == nil {
+		return nil, ErrSnapshotNotFound
+	}
+	return newSnapshotDiff(fromSnapshot, toSnapshot), nil
+}
+
+// runChangesJob makes a playlist of the tracks that are new in one of the
+// user's snapshots since another, keeps a record of how it went and lets them
+// know.
+func runChangesJob(key string, playlistJob PlaylistJob, redisClient redis.UniversalClient, logger logrus.FieldLogger, GetSpotifyClient func(token *oauth2.Token) (SpotifyClienter, error), notifier Notifier) {
+	job := &Job{Type: "changes", RequestID: playlistJob.RequestID, StartedAt: timeNow()}
+	playlist, err := createChangesPlaylist(key, playlistJob.ChangesFrom, playlistJob.ChangesTo, redisClient, logger, GetSpotifyClient)
+	var created *Event
+	if playlist != nil {
+		created = &Event{Type: EventChangesCreated, Changes: playlist}
+	}
+	finishJob(key, job, created, err, redisClient, logger, notifier)
+}
+
+// createChangesPlaylist makes a playlist of the tracks in the user's to
+// snapshot that weren't in their from one. The playlist isn't kept in their
+// history, since it isn't a snapshot of their top songs. If there aren't any
+// new tracks, no playlist is returned.
+func createChangesPlaylist(key string, from, to spotify.ID, redisClient redis.UniversalClient, logger logrus.FieldLogger, GetSpotifyClient func(token *oauth2.Token) (SpotifyClienter, error)) (*ChangesPlaylist, error) {
+	logger.Infof("creating changes playlist from %s to %s", from, to)
+
+	fields, err := redisClient.HGetAll(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	if _, ok := fields[NeedsReauthField]; ok {
+		logger.Info("ignore changes playlist since authorization needs renewing")
+		return nil, nil
+	}
+	refreshToken, ok := fields[RefreshTokenField]
+	if !ok {
+		return nil, fmt.Errorf("couldn't get refresh token")
+	}
+	_, isPrivate := fields[IsPrivateField]
+
+	userID := strings.Split(key, ":")[1]
+	diff, err := loadSnapshotDiff(redisClient, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(diff.Added) == 0 {
+		logger.Info("ignore changes playlist since there are no new tracks")
+		return nil, nil
+	}
+
+	token := &oauth2.Token{RefreshToken: refreshToken}
+	client, err := GetSpotifyClient(token)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't refresh token: %w", err)
+	}
+	spotClient := instrumentSpotifyClient(client)
+	playlistName := fmt.Sprintf("Your New Songs %s", periodTitle(diff.ToPeriod))
+	playlistDesc := fmt.Sprintf("Songs in your top songs for %s that weren't in %s, made by %s", periodTitle(diff.ToPeriod), periodTitle(diff.FromPeriod), DomainName)
+	fullPlaylist, err := spotClient.CreatePlaylistForUser(userID, playlistName, playlistDesc, !isPrivate)
+	if err != nil {
+		return nil, fmt.Errorf("err creating playlist for user: %w", err)
+	}
+	trackIDs := make([]spotify.ID, len(diff.Added))
+	tracks := make([]SnapshotTrack, len(diff.Added))
+	for i, change := range diff.Added {
+		trackIDs[i] = change.Track.ID
+		tracks[i] = change.Track
+	}
+	_, err = spotClient.AddTracksToPlaylist(fullPlaylist.ID, trackIDs...)
+	if err != nil {
+		return nil, fmt.Errorf("err adding tracks to playlist: %w", err)
+	}
+	cover, err := renderCover(userID, diff.ToPeriod)
+	if err == nil {
+		err = spotClient.SetPlaylistImage(fullPlaylist.ID, bytes.NewReader(cover))
+	}
+	if err != nil {
+		logger.Warnf("couldn't set playlist cover: %s", err)
+	}
+
+	logger.Info("created changes playlist")
+	return &ChangesPlaylist{
+		PlaylistID: fullPlaylist.ID,
+		Name:       playlistName,
+		Private:    isPrivate,
+		From:       from,
+		To:         to,
+		CreatedAt:  timeNow(),
+		Tracks:     tracks,
+	}, nil
+}
+
+// Diff compares two of the user's snapshots, given by their playlist IDs in
+// the from and to form values. It compares their latest two if neither is
+// given.
+func Diff(diffTmpl *template.Template, store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		setRequestUser(r, logger, userID)
+
+		snapshots, err := Snapshots(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		from, to := spotify.ID(r.FormValue("from")), spotify.ID(r.FormValue("to"))
+		if from == "" && to == "" && len(snapshots) >= 2 {
+			from, to = snapshots[len(snapshots)-2].PlaylistID, snapshots[len(snapshots)-1].PlaylistID
+		}
+		var diff *SnapshotDiff
+		var fromTitle, toTitle string
+		if from != "" || to != "" {
+			diff, err = loadSnapshotDiff(redisClient, userID, from, to)
+			if err != nil {
+				return err
+			}
+			fromTitle, toTitle = periodTitle(diff.FromPeriod), periodTitle(diff.ToPeriod)
+		}
+		// Newest first, to pick from.
+		choices := make([]Snapshot, len(snapshots))
+		for i, s := range snapshots {
+			choices[len(snapshots)-1-i] = s
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return diffTmpl.Execute(w, map[string]interface{}{
+			"Diff":      diff,
+			"From":      from,
+			"To":        to,
+			"FromTitle": fromTitle,
+			"ToTitle":   toTitle,
+			"Snapshots": choices,
+			"Queued":    r.FormValue("queued") != "",
+			"CSRFField": csrf.TemplateField(r),
+		})
+	}
+}
+
+// DiffPlaylist queues a playlist of the tracks that are new in the user's to
+// snapshot since their from one.
+func DiffPlaylist(store sessions.Store, redisClient redis.UniversalClient, playlistNowCh chan<- PlaylistJob, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
+
+		from, to := spotify.ID(r.FormValue("from")), spotify.ID(r.FormValue("to"))
+		_, err = loadSnapshotDiff(redisClient, userID, from, to)
+		if err != nil {
+			return err
+		}
+		err = queuePlaylistJob(redisClient, playlistNowCh, PlaylistJob{UserID: spotify.ID(userID), ChangesFrom: from, ChangesTo: to, RequestID: RequestID(r)})
+		if err != nil {
+			return err
+		}
+		logger.Infof("queued changes playlist from %s to %s", from, to)
+
+		query := url.Values{"from": {string(from)}, "to": {string(to)}, "queued": {"true"}}
+		http.Redirect(w, r, "/diff?"+query.Encode(), http.StatusFound)
+		return nil
+	}
+}
@@ -0,0 +1,208 @@
+package spotshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+func TestNewSnapshotDiff(t *testing.T) {
+	from := &Snapshot{Period: "2019-07", Tracks: []SnapshotTrack{
+		reviewTrack("a", "ABBA"), reviewTrack("b", "Blur"), reviewTrack("c", "Cher"), reviewTrack("d", "Blur"),
+	}}
+	to := &Snapshot{Period: "2019-08", Tracks: []SnapshotTrack{
+		reviewTrack("c", "Cher"), reviewTrack("e", "Dido"), reviewTrack("a", "ABBA"), reviewTrack("d", "Blur"),
+	}}
+	diff := newSnapshotDiff(from, to)
+
+	if len(diff.Added) != 1 || diff.Added[0].Track.ID != "e" || diff.Added[0].ToRank != 2 {
+		t.Errorf("expected e to be added at #2, got %+v", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0].Track.ID != "b" || diff.Removed[0].FromRank != 2 {
+		t.Errorf("expected b to be removed from #2, got %+v", diff.Removed)
+	}
+	var moved []string
+	for _, c := range diff.Moved {
+		moved = append(moved, fmt.Sprintf("%s%+d", c.Track.ID, c.Change))
+	}
+	if strings.Join(moved, " ") != "c+2 a-2 d+0" {
+		t.Errorf("expected c up 2, a down 2 and d to stay, got %v", moved)
+	}
+	if fmt.Sprint(diff.ArtistsEntered, diff.ArtistsLeft) != "[Dido] []" {
+		t.Errorf("expected Dido to enter and no one to leave, got %v and %v", diff.ArtistsEntered, diff.ArtistsLeft)
+	}
+
+	diff = newSnapshotDiff(to, from)
+	if fmt.Sprint(diff.ArtistsEntered, diff.ArtistsLeft) != "[] [Dido]" {
+		t.Errorf("expected Dido to leave going backwards, got %v and %v", diff.ArtistsEntered, diff.ArtistsLeft)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	RegisterGobEncodings()
+	store := sessions.NewCookieStore([]byte("authentication-key"))
+	user := "coolkid99"
+	for _, snapshot := range []*Snapshot{
+		{Period: "2019-07", PlaylistID: "p07", Name: "Your Top Songs Jul 19", Tracks: []SnapshotTrack{reviewTrack("a", "ABBA"), reviewTrack("b", "Blur")}},
+		{Period: "2019-08", PlaylistID: "p08", Name: "Your Top Songs Aug 19", Tracks: []SnapshotTrack{reviewTrack("b", "Blur"), reviewTrack("c", "<Cher>")}},
+	} {
+		err = saveSnapshot(redisClient, user, snapshot)
+		if err != nil {
+			t.Fatalf("couldn't save snapshot: %s", err)
+		}
+	}
+
+	// The page compares the latest two by default.
+	diffTmpl := template.Must(template.ParseFiles("../../templates/diff.html.tmpl"))
+	w := httptest.NewRecorder()
+	err = Diff(diffTmpl, store, redisClient, logger)(w, loggedInRequest(t, store, "GET", "/diff", "", user))
+	if err != nil {
+		t.Fatalf("diff failed: %s", err)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`<h2>From July 2019 to August 2019</h2>`,
+		`<option value="p08" selected>Your Top Songs Aug 19</option>`,
+		`<a href="/api/v1/diff?from=p07&to=p08" download="spotshot-diff-2019-07-2019-08.json">`,
+		`<span class="rank-up">&#9650; 1</span>`,
+		`<p>In: &lt;Cher&gt;</p>`,
+		`<p>Out: ABBA</p>`,
+		`<input class="btn btn-primary" type="submit" value="Make a playlist of them">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected page to contain %s, got:\n%s", want, body)
+		}
+	}
+
+	// The API compares the given snapshots.
+	w = httptest.NewRecorder()
+	endpoint := &APIEndpoint{APIHandlerFunc: APIGetDiff(redisClient), Store: store, Logger: logger}
+	endpoint.ServeHTTP(w, loggedInRequest(t, store, "GET", "/api/v1/diff?from=p08&to=p07", "", user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var diff SnapshotDiff
+	err = json.NewDecoder(w.Body).Decode(&diff)
+	if err != nil {
+		t.Fatalf("couldn't decode diff: %s", err)
+	}
+	if diff.From != "p08" || diff.FromPeriod != "2019-08" || len(diff.Added) != 1 || diff.Added[0].Track.ID != "a" || diff.Moved[0].Change != -1 {
+		t.Errorf("unexpected diff %+v", diff)
+	}
+	w = httptest.NewRecorder()
+	endpoint.ServeHTTP(w, loggedInRequest(t, store, "GET", "/api/v1/diff?from=p06&to=p07", "", user))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for a missing snapshot, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// Making a playlist of the new songs is queued.
+	playlistNowCh := make(chan PlaylistJob, 1)
+	w = httptest.NewRecorder()
+	r := loggedInRequest(t, store, "POST", "/diff/playlist", "from=p07&to=p08", user)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	err = DiffPlaylist(store, redisClient, playlistNowCh, logger)(w, r)
+	if err != nil {
+		t.Fatalf("diff playlist failed: %s", err)
+	}
+	if job := <-playlistNowCh; job.ChangesFrom != "p07" || job.ChangesTo != "p08" {
+		t.Errorf("unexpected job %+v", job)
+	}
+	if loc := w.Header().Get("Location"); loc != "/diff?from=p07&queued=true&to=p08" {
+		t.Errorf("unexpected redirect to %s", loc)
+	}
+}
+
+func TestRunChangesJob(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	user := "coolkid99"
+	key := fmt.Sprintf("%s:%s", RedisUserIDKey, user)
+	s.HSet(key, RefreshTokenField, "test")
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	// Two one-offs from the same day are told apart by their playlists.
+	for _, snapshot := range []*Snapshot{
+		{Period: "2019-08-14", OneOff: true, PlaylistID: "first", Tracks: []SnapshotTrack{reviewTrack("a", "ABBA")}},
+		{Period: "2019-08-14", OneOff: true, PlaylistID: "second", Tracks: []SnapshotTrack{reviewTrack("b", "Blur"), reviewTrack("a", "ABBA"), reviewTrack("c", "Cher")}},
+	} {
+		err = saveSnapshot(redisClient, user, snapshot)
+		if err != nil {
+			t.Fatalf("couldn't save snapshot: %s", err)
+		}
+	}
+
+	msc := &mockSpotifyClient{}
+	getClient := func(*oauth2.Token) (SpotifyClienter, error) { return msc, nil }
+	var events []*Event
+	notifier := notifierFunc(func(e *Event) error {
+		events = append(events, e)
+		return nil
+	})
+	runChangesJob(key, PlaylistJob{ChangesFrom: "first", ChangesTo: "second"}, redisClient, logger, getClient, notifier)
+	if len(msc.playlists) != 1 {
+		t.Fatalf("expected 1 playlist, got %d", len(msc.playlists))
+	}
+	p := msc.playlists[0]
+	if p.name != "Your New Songs 14 August 2019" || fmt.Sprint(p.tracks) != "[b c]" || !p.public {
+		t.Errorf("unexpected playlist %+v", p)
+	}
+	// It isn't a snapshot, so it has its own event.
+	if len(events) != 1 || events[0].Type != EventChangesCreated || events[0].Snapshot != nil ||
+		events[0].Changes == nil || events[0].Changes.From != "first" || events[0].Changes.To != "second" || events[0].UserID != user {
+		t.Errorf("expected a changes.created event, got %+v", events)
+	}
+	snapshots, err := Snapshots(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't get snapshots: %s", err)
+	}
+	if len(snapshots) != 2 {
+		t.Errorf("expected the changes playlist not to be kept in history, got %d snapshots", len(snapshots))
+	}
+	jobs, err := Jobs(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't get jobs: %s", err)
+	}
+	if len(jobs) != 1 || jobs[0].Type != "changes" || jobs[0].Err != "" {
+		t.Errorf("expected a successful changes job, got %+v", jobs)
+	}
+
+	// Going backwards there's nothing new.
+	runChangesJob(key, PlaylistJob{ChangesFrom: "second", ChangesTo: "first"}, redisClient, logger, getClient, Notifiers(nil))
+	if len(msc.playlists) != 1 {
+		t.Errorf("expected no playlist without new songs, got %d", len(msc.playlists))
+	}
+}
+
+// notifierFunc lets a function be used as a Notifier.
+type notifierFunc func(e *Event) error
+
+func (f notifierFunc) Notify(e *Event) error {
+	return f(e)
+}
@@ -0,0 +1,672 @@
+package spotshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	RedisEmailKey         = "spot_usr_email"
+	RedisEmailQueueKey    = "spot_email_queue"
+	RedisEmailCooldownKey = "spot_usr_email_cooldown"
+
+	// EmailUnsubscribePath is where the unsubscribe link in emails goes.
+	EmailUnsubscribePath = "/email/unsubscribe"
+
+	emailAddressField          = "address"
+	emailConfirmedField        = "confirmed"
+	emailConfirmTokenField     = "confirm_token"
+	emailConfirmExpiryField    = "confirm_expiry"
+	emailUnsubscribeTokenField = "unsubscribe_token"
+
+	// emailConfirmLifetime is how long users have to confirm their address.
+	emailConfirmLifetime = 24 * time.Hour
+	// emailConfirmCooldown is how long users wait between confirmation
+	// emails, so the form can't be used to flood someone's inbox.
+	emailConfirmCooldown = 5 * time.Minute
+	// smtpTimeout bounds how long sending an email can hold up the queue.
+	smtpTimeout = 30 * time.Second
+	// emailTopTracks is how many of the top tracks are listed in emails.
+	emailTopTracks = 5
+)
+
+var (
+	emailPollFreq = time.Second
+	// emailBackoff is how long to wait before each retry of a failed email.
+	emailBackoff = []time.Duration{time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour}
+
+	confirmEmailTmpl = texttemplate.Must(texttemplate.New("confirm").Parse(`Hi,
+
+Someone, hopefully you, asked for Spotshot to email {{ .Address }} when there's a new playlist.
+To confirm, go to:
+
+{{ .URL }}
+
+If it wasn't you, you can ignore this email.
+`))
+	snapshotEmailTmpl = texttemplate.Must(texttemplate.New("snapshot").Funcs(texttemplate.FuncMap{
+		"inc": func(i int) int { return i + 1 },
+	}).Parse(`Hi,
+
+Your playlist "{{ .Snapshot.Name }}" is ready:
+
+{{ .Snapshot.PlaylistURL }}
+{{ if .Tracks }}
+Your top songs were:
+{{ range $i, $track := .Tracks }}
+{{ inc $i }}. {{ $track.Name }} - {{ $track.ArtistNames }}{{ end }}
+{{ end }}
+To stop getting these emails, go to {{ .UnsubscribeURL }}
+`))
+	revokedEmailTmpl = texttemplate.Must(texttemplate.New("revoked").Parse(`Hi,
+
+Spotshot no longer has access to your Spotify account, so we couldn't make your playlist.
+To keep getting playlists, log in again at:
+
+{{ .BaseURL }}
+
+If you don't, you'll be unsubscribed after a few months.
+
+To stop getting these emails, go to {{ .UnsubscribeURL }}
+`))
+)
+
+// EmailSettings is where a user wants their notification emails sent.
+type EmailSettings struct {
+	Address   string `json:"address"`
+	Confirmed bool   `json:"confirmed"`
+}
+
+// queuedEmail is an email waiting to be sent.
+type queuedEmail struct {
+	ID             string `json:"id"`
+	To             string `json:"to"`
+	Subject        string `json:"subject"`
+	Body           string `json:"body"`
+	UnsubscribeURL string `json:"unsubscribe_url,omitempty"`
+	// Attempt is how many times sending has been tried.
+	Attempt int `json:"attempt"`
+}
+
+// Mailer sends emails over SMTP. It notifies users that have confirmed their
+// email address about their playlists. Emails are queued in Redis and sent
+// by Run, so a slow or broken SMTP server doesn't hold up playlists.
+type Mailer struct {
+	// Addr is the SMTP server's host:port.
+	Addr string
+	Auth smtp.Auth
+	From string
+	// BaseURL is where Spotshot is served from, for links in emails.
+	BaseURL     string
+	redisClient redis.UniversalClient
+	logger      logrus.FieldLogger
+}
+
+// NewMailer creates a Mailer for the SMTP server at addr. If username is
+// empty no authentication is used.
+func NewMailer(addr, username, password, from, baseURL string, redisClient redis.UniversalClient, logger logrus.FieldLogger) *Mailer {
+	m := &Mailer{
+		Addr:        addr,
+		From:        from,
+		BaseURL:     strings.TrimSuffix(baseURL, "/"),
+		redisClient: redisClient,
+		logger:      logger,
+	}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// Notify queues an email to the user about new playlists, and if they need
+// to log in again so we can keep making them.
+func (m *Mailer) Notify(e *Event) error {
+	settings, err := getEmailSettings(m.redisClient, e.UserID)
+	if err != nil {
+		return err
+	}
+	if settings == nil || !settings.Confirmed {
+		return nil
+	}
+	unsubscribeURL, err := m.unsubscribeURL(e.UserID)
+	if err != nil {
+		return err
+	}
+
+	var subject string
+	var body bytes.Buffer
+	switch {
+	case e.Type == EventSnapshotCreated:
+		subject = fmt.Sprintf("%s is ready", e.Snapshot.Name)
+		err = snapshotEmailTmpl.Execute(&body, map[string]interface{}{
+			"Snapshot":       e.Snapshot,
+			"Tracks":         topTracks(e.Snapshot, emailTopTracks),
+			"UnsubscribeURL": unsubscribeURL,
+		})
+	case e.Type == EventSnapshotFailed && e.Revoked:
+		subject = "Reconnect Spotify to keep getting playlists"
+		err = revokedEmailTmpl.Execute(&body, map[string]interface{}{
+			"BaseURL":        m.BaseURL,
+			"UnsubscribeURL": unsubscribeURL,
+		})
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't render email: %w", err)
+	}
+	return m.queue(settings.Address, subject, body.String(), unsubscribeURL)
+}
+
+// queue adds an email to be sent as soon as possible.
+func (m *Mailer) queue(to, subject, body, unsubscribeURL string) error {
+	id, err := randToken(12)
+	if err != nil {
+		return fmt.Errorf("couldn't generate email ID: %w", err)
+	}
+	return m.enqueue(&queuedEmail{ID: id, To: to, Subject: subject, Body: body, UnsubscribeURL: unsubscribeURL}, timeNow())
+}
+
+func (m *Mailer) enqueue(e *queuedEmail, at time.Time) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("couldn't encode email: %w", err)
+	}
+	err = m.redisClient.ZAdd(RedisEmailQueueKey, redis.Z{Score: float64(at.Unix()), Member: b}).Err()
+	if err != nil {
+		return fmt.Errorf("couldn't add to redis key %s: %w", RedisEmailQueueKey, err)
+	}
+	return nil
+}
+
+// Run sends queued emails until the context is done.
+func (m *Mailer) Run(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(emailPollFreq):
+		case <-ctx.Done():
+			return
+		}
+		m.sendDue(ctx)
+	}
+}
+
+// sendDue sends the queued emails that are due.
+func (m *Mailer) sendDue(ctx context.Context) {
+	due, err := m.redisClient.ZRangeByScore(RedisEmailQueueKey, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(timeNow().Unix(), 10),
+	}).Result()
+	if err != nil {
+		m.logger.Errorf("couldn't get redis key %s: %s", RedisEmailQueueKey, err)
+		return
+	}
+	for _, member := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		// Removing the email claims it, in case another instance is also
+		// sending.
+		n, err := m.redisClient.ZRem(RedisEmailQueueKey, member).Result()
+		if err != nil {
+			m.logger.Errorf("couldn't remove from redis key %s: %s", RedisEmailQueueKey, err)
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		e := new(queuedEmail)
+		err = json.Unmarshal([]byte(member), e)
+		if err != nil {
+			m.logger.Errorf("couldn't decode email: %s", err)
+			continue
+		}
+		m.deliver(e)
+	}
+}
+
+// deliver tries to send the email, queueing it to be tried again later if it
+// fails.
+func (m *Mailer) deliver(e *queuedEmail) {
+	logger := m.logger.WithField("email_id", e.ID)
+	e.Attempt++
+	err := m.send(e.To, e.Subject, e.Body, e.UnsubscribeURL)
+	if err == nil {
+		return
+	}
+	if e.Attempt > len(emailBackoff) {
+		logger.Errorf("giving up sending email after %d attempts: %s", e.Attempt, err)
+		return
+	}
+	logger.Warnf("couldn't send email, retrying: %s", err)
+	err = m.enqueue(e, timeNow().Add(emailBackoff[e.Attempt-1]))
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (m *Mailer) unsubscribeURL(userID string) (string, error) {
+	key := fmt.Sprintf("%s:%s", RedisEmailKey, userID)
+	token, err := m.redisClient.HGet(key, emailUnsubscribeTokenField).Result()
+	if err != nil {
+		return "", fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	return fmt.Sprintf("%s%s?%s", m.BaseURL, EmailUnsubscribePath, url.Values{"user": {userID}, "token": {token}}.Encode()), nil
+}
+
+// send emails a plain text message. If unsubscribeURL is given it's added as
+// a List-Unsubscribe header, so mail clients can offer an unsubscribe button
+// that POSTs to it (RFC 8058).
+func (m *Mailer) send(to, subject, body, unsubscribeURL string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", timeNow().Format(time.RFC1123Z))
+	if unsubscribeURL != "" {
+		fmt.Fprintf(&msg, "List-Unsubscribe: <%s>\r\n", unsubscribeURL)
+		msg.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	}
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	conn, err := net.DialTimeout("tcp", m.Addr, smtpTimeout)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to SMTP server: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	host, _, _ := net.SplitHostPort(m.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("couldn't connect to SMTP server: %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return fmt.Errorf("couldn't start TLS: %w", err)
+		}
+	}
+	if m.Auth != nil {
+		err = c.Auth(m.Auth)
+		if err != nil {
+			return fmt.Errorf("couldn't authenticate with SMTP server: %w", err)
+		}
+	}
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address: %w", err)
+	}
+	err = c.Mail(from.Address)
+	if err == nil {
+		err = c.Rcpt(to)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't send email: %w", err)
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("couldn't send email: %w", err)
+	}
+	_, err = wc.Write(msg.Bytes())
+	if err == nil {
+		err = wc.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't send email: %w", err)
+	}
+	return c.Quit()
+}
+
+// getEmailSettings returns where the user wants emails sent, or nil if they
+// haven't given an address.
+func getEmailSettings(redisClient redis.UniversalClient, userID string) (*EmailSettings, error) {
+	key := fmt.Sprintf("%s:%s", RedisEmailKey, userID)
+	fields, err := redisClient.HGetAll(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	if fields[emailAddressField] == "" {
+		return nil, nil
+	}
+	_, confirmed := fields[emailConfirmedField]
+	return &EmailSettings{Address: fields[emailAddressField], Confirmed: confirmed}, nil
+}
+
+// setEmail saves the user's address, which needs to be confirmed with the
+// returned token before any emails are sent to it.
+func setEmail(redisClient redis.UniversalClient, userID, address string) (string, error) {
+	if address == "" {
+		return "", ExpectedFormValueError{"email"}
+	}
+	addr, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", InvalidValueError{"email", address}
+	}
+	confirmToken, err := randToken(32)
+	if err != nil {
+		return "", fmt.Errorf("couldn't generate token: %w", err)
+	}
+	unsubscribeToken, err := randToken(32)
+	if err != nil {
+		return "", fmt.Errorf("couldn't generate token: %w", err)
+	}
+	key := fmt.Sprintf("%s:%s", RedisEmailKey, userID)
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(key)
+		pipe.HMSet(key, map[string]interface{}{
+			emailAddressField:          addr.Address,
+			emailConfirmTokenField:     confirmToken,
+			emailConfirmExpiryField:    timeNow().Add(emailConfirmLifetime).Unix(),
+			emailUnsubscribeTokenField: unsubscribeToken,
+		})
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't save email: %w", err)
+	}
+	return confirmToken, nil
+}
+
+// checkEmailToken returns the user's email settings fields if token matches
+// the one in field.
+func checkEmailToken(redisClient redis.UniversalClient, userID, field, token string) (map[string]string, error) {
+	key := fmt.Sprintf("%s:%s", RedisEmailKey, userID)
+	fields, err := redisClient.HGetAll(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	want := fields[field]
+	if want == "" || token == "" || subtle.ConstantTimeCompare([]byte(want), []byte(token)) != 1 {
+		return nil, ErrInvalidEmailToken
+	}
+	return fields, nil
+}
+
+func confirmEmail(redisClient redis.UniversalClient, userID, token string) error {
+	fields, err := checkEmailToken(redisClient, userID, emailConfirmTokenField, token)
+	if err != nil {
+		return err
+	}
+	expiry, err := strconv.ParseInt(fields[emailConfirmExpiryField], 10, 64)
+	if err != nil || timeNow().After(time.Unix(expiry, 0)) {
+		return ErrInvalidEmailToken
+	}
+	key := fmt.Sprintf("%s:%s", RedisEmailKey, userID)
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, emailConfirmedField, "")
+		pipe.HDel(key, emailConfirmTokenField, emailConfirmExpiryField)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't confirm email: %w", err)
+	}
+	return nil
+}
+
+// startEmailCooldown returns ErrEmailCooldown if the user was sent a
+// confirmation email recently, and otherwise stops them being sent another
+// for a while.
+func startEmailCooldown(redisClient redis.UniversalClient, userID string) error {
+	key := fmt.Sprintf("%s:%s", RedisEmailCooldownKey, userID)
+	ok, err := redisClient.SetNX(key, 1, emailConfirmCooldown).Result()
+	if err != nil {
+		return fmt.Errorf("error while setting redis key %s: %w", key, err)
+	}
+	if !ok {
+		return ErrEmailCooldown
+	}
+	return nil
+}
+
+func deleteEmail(redisClient redis.UniversalClient, userID string) error {
+	key := fmt.Sprintf("%s:%s", RedisEmailKey, userID)
+	err := redisClient.Del(key).Err()
+	if err != nil {
+		return fmt.Errorf("couldn't delete redis key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Settings shows the user's sharing and notification settings: their email,
+// webhooks, feed and public pages.
+func Settings(settingsTmpl *template.Template, store sessions.Store, redisClient redis.UniversalClient, mailer *Mailer, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
+
+		email, err := getEmailSettings(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		webhooks, err := Webhooks(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		webhookLog, err := WebhookLog(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		var feed string
+		token, err := feedToken(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			feed = feedURL(userID, token)
+		}
+		public, err := getPublicSettings(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		var publicSnaps []Snapshot
+		if public != nil {
+			snapshots, err := Snapshots(redisClient, userID)
+			if err != nil {
+				return err
+			}
+			publicSnaps = publicSnapshots(snapshots, public.SharePrivate)
+		}
+		w.WriteHeader(http.StatusOK)
+		return settingsTmpl.Execute(w, map[string]interface{}{
+			"EmailEnabled": mailer != nil,
+			"Email":        email,
+			"Webhooks":     webhooks,
+			"WebhookLog":   webhookLog,
+			"FeedURL":      feed,
+			"Public":       public,
+			"PublicSnaps":  publicSnaps,
+			"CSRFField":    csrf.TemplateField(r),
+		})
+	}
+}
+
+// SetEmail saves the user's email address, or removes it if it's empty, and
+// sends a confirmation email to it.
+func SetEmail(store sessions.Store, redisClient redis.UniversalClient, mailer *Mailer, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
+
+		address := strings.TrimSpace(r.FormValue("email"))
+		if address == "" {
+			err = deleteEmail(redisClient, userID)
+			if err != nil {
+				return err
+			}
+			logger.Info("removed email")
+			http.Redirect(w, r, "/settings", http.StatusFound)
+			return nil
+		}
+		if mailer == nil {
+			return ErrEmailDisabled
+		}
+		err = startEmailCooldown(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		token, err := setEmail(redisClient, userID, address)
+		if err != nil {
+			return err
+		}
+		settings, err := getEmailSettings(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		var body bytes.Buffer
+		err = confirmEmailTmpl.Execute(&body, map[string]interface{}{
+			"Address": settings.Address,
+			"URL":     fmt.Sprintf("%s/email/confirm?%s", mailer.BaseURL, url.Values{"user": {userID}, "token": {token}}.Encode()),
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't render email: %w", err)
+		}
+		err = mailer.queue(settings.Address, "Confirm your email for Spotshot", body.String(), "")
+		if err != nil {
+			return err
+		}
+		logger.Info("queued email confirmation")
+
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+}
+
+// SkipEmailCSRF lets mail clients POST to the unsubscribe link without a CSRF
+// token, for one-click unsubscribing. The token in the link authenticates the
+// request instead. It has to go before CSRF protection.
+func SkipEmailCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == EmailUnsubscribePath {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// renderEmailForm shows a page with a button that POSTs the link's user and
+// token to action. Links in emails open these pages rather than changing
+// anything themselves, since mail scanners and link previews follow them.
+func renderEmailForm(w http.ResponseWriter, r *http.Request, emailTmpl *template.Template, action, title, message, button string) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	return emailTmpl.Execute(w, map[string]interface{}{
+		"Title":     title,
+		"Message":   message,
+		"Action":    action,
+		"Button":    button,
+		"UserID":    r.FormValue("user"),
+		"Token":     r.FormValue("token"),
+		"CSRFField": csrf.TemplateField(r),
+	})
+}
+
+// ConfirmEmailPage is where the link in confirmation emails goes. It asks the
+// user to confirm their address.
+func ConfirmEmailPage(emailTmpl *template.Template, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		_, err := checkEmailToken(redisClient, r.FormValue("user"), emailConfirmTokenField, r.FormValue("token"))
+		if err != nil {
+			return err
+		}
+		return renderEmailForm(w, r, emailTmpl, "/email/confirm", "Confirm your email",
+			"Get an email from Spotshot whenever there's a new playlist.", "Confirm")
+	}
+}
+
+// ConfirmEmail confirms the user's address with the token from the link in
+// their confirmation email. They don't need to be logged in.
+func ConfirmEmail(msgTmpl *template.Template, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		userID := r.FormValue("user")
+		err := confirmEmail(redisClient, userID, r.FormValue("token"))
+		if err != nil {
+			return err
+		}
+		setRequestUser(r, logger, userID).Info("confirmed email")
+		return renderError(w, msgTmpl, http.StatusOK, "Email confirmed", "You'll get an email whenever there's a new playlist.")
+	}
+}
+
+// UnsubscribeEmailPage is where the unsubscribe link in emails goes. It asks
+// the user to confirm they want to stop getting emails.
+func UnsubscribeEmailPage(emailTmpl *template.Template, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		_, err := checkEmailToken(redisClient, r.FormValue("user"), emailUnsubscribeTokenField, r.FormValue("token"))
+		if err != nil {
+			return err
+		}
+		return renderEmailForm(w, r, emailTmpl, EmailUnsubscribePath, "Stop emails",
+			"Stop getting emails from Spotshot. Your playlists will still be made.", "Unsubscribe")
+	}
+}
+
+// UnsubscribeEmail stops emails to the user, using the token from the link
+// in every email. They don't need to be logged in, and mail clients can
+// POST to the link directly.
+func UnsubscribeEmail(msgTmpl *template.Template, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		userID := r.FormValue("user")
+		_, err := checkEmailToken(redisClient, userID, emailUnsubscribeTokenField, r.FormValue("token"))
+		if err != nil {
+			return err
+		}
+		err = deleteEmail(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		setRequestUser(r, logger, userID).Info("unsubscribed from emails")
+		return renderError(w, msgTmpl, http.StatusOK, "Unsubscribed", "You won't get any more emails from Spotshot. Your playlists will still be made.")
+	}
+}
@@ -0,0 +1,325 @@
+package spotshot
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeSMTPServer accepts emails and sends their contents to the returned
+// channel.
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	msgs := make(chan string, 10)
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tc := textproto.NewConn(conn)
+				tc.PrintfLine("220 localhost ESMTP")
+				for {
+					line, err := tc.ReadLine()
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+					case "EHLO", "HELO":
+						tc.PrintfLine("250 localhost")
+					case "DATA":
+						tc.PrintfLine("354 go ahead")
+						b, err := tc.ReadDotBytes()
+						if err != nil {
+							return
+						}
+						msgs <- string(b)
+						tc.PrintfLine("250 ok")
+					case "QUIT":
+						tc.PrintfLine("221 bye")
+						return
+					default:
+						tc.PrintfLine("250 ok")
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), msgs
+}
+
+func TestMailerNotify(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	addr, msgs := fakeSMTPServer(t)
+	mailer := NewMailer(addr, "", "", "Spotshot <noreply@example.com>", "https://example.com", redisClient, logger)
+	ctx := context.Background()
+	user := "coolkid99"
+
+	snapshot := &Snapshot{Name: "Your Top Songs Aug 19", PlaylistID: "abc"}
+	for i := 1; i <= 6; i++ {
+		snapshot.Tracks = append(snapshot.Tracks, SnapshotTrack{
+			Name:    fmt.Sprintf("Song %d", i),
+			Artists: []SnapshotArtist{{Name: "Artist"}},
+		})
+	}
+	event := &Event{Type: EventSnapshotCreated, UserID: user, Snapshot: snapshot}
+
+	// Nothing is sent until the address is confirmed.
+	token, err := setEmail(redisClient, user, "cool@example.com")
+	if err != nil {
+		t.Fatalf("couldn't set email: %s", err)
+	}
+	err = mailer.Notify(event)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.Exists(RedisEmailQueueKey) {
+		t.Errorf("expected no email to be queued before confirming")
+	}
+	if err = confirmEmail(redisClient, user, "wrong"); err != ErrInvalidEmailToken {
+		t.Fatalf("expected %s, got %v", ErrInvalidEmailToken, err)
+	}
+	err = confirmEmail(redisClient, user, token)
+	if err != nil {
+		t.Fatalf("couldn't confirm email: %s", err)
+	}
+
+	// Emails are only queued by Notify, and sent separately.
+	err = mailer.Notify(event)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	mailer.sendDue(ctx)
+	msg := <-msgs
+	for _, want := range []string{
+		"To: cool@example.com",
+		"Subject: Your Top Songs Aug 19 is ready",
+		"https://open.spotify.com/playlist/abc",
+		"5. Song 5 - Artist",
+		"List-Unsubscribe: <https://example.com/email/unsubscribe?",
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected email to contain %q, got:\n%s", want, msg)
+		}
+	}
+	if strings.Contains(msg, "Song 6") {
+		t.Errorf("expected only the top %d songs, got:\n%s", emailTopTracks, msg)
+	}
+
+	// Users hear about losing access, but not other failures.
+	err = mailer.Notify(&Event{Type: EventSnapshotFailed, UserID: user, Err: "spotify is down"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err = mailer.Notify(&Event{Type: EventSnapshotFailed, UserID: user, Revoked: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	mailer.sendDue(ctx)
+	msg = <-msgs
+	if !strings.Contains(msg, "Subject: Reconnect Spotify") {
+		t.Errorf("expected reconnect email, got:\n%s", msg)
+	}
+
+	// The unsubscribe link stops emails.
+	unsubscribeToken := s.HGet(fmt.Sprintf("%s:%s", RedisEmailKey, user), emailUnsubscribeTokenField)
+	if _, err = checkEmailToken(redisClient, user, emailUnsubscribeTokenField, unsubscribeToken); err != nil {
+		t.Fatalf("expected unsubscribe token to be valid, got %s", err)
+	}
+	err = deleteEmail(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't delete email: %s", err)
+	}
+	err = mailer.Notify(event)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	mailer.sendDue(ctx)
+	select {
+	case msg = <-msgs:
+		t.Errorf("expected no email after unsubscribing, got:\n%s", msg)
+	default:
+	}
+}
+
+func TestMailerRetries(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	now := time.Unix(1000000, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	// Nothing is listening, so sending fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	l.Close()
+	mailer := NewMailer(l.Addr().String(), "", "", "noreply@example.com", "https://example.com", redisClient, logger)
+	err = mailer.queue("cool@example.com", "Hi", "Hello", "")
+	if err != nil {
+		t.Fatalf("couldn't queue email: %s", err)
+	}
+	for i := range emailBackoff {
+		mailer.sendDue(context.Background())
+		members, err := s.ZMembers(RedisEmailQueueKey)
+		if err != nil || len(members) != 1 {
+			t.Fatalf("expected the email to be queued for a retry, got %v %v", members, err)
+		}
+		score, _ := s.ZScore(RedisEmailQueueKey, members[0])
+		if want := now.Add(emailBackoff[i]).Unix(); int64(score) != want {
+			t.Errorf("expected retry %d at %d, got %d", i+1, want, int64(score))
+		}
+		now = now.Add(emailBackoff[i])
+	}
+	// After the last retry it's given up on.
+	mailer.sendDue(context.Background())
+	if s.Exists(RedisEmailQueueKey) {
+		t.Errorf("expected the email to be dropped after %d retries", len(emailBackoff))
+	}
+}
+
+func TestEmailLinks(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	errTmpl := template.Must(template.ParseFiles("../../templates/error.html.tmpl"))
+	emailTmpl := template.Must(template.ParseFiles("../../templates/email.html.tmpl"))
+	user := "coolkid99"
+	key := fmt.Sprintf("%s:%s", RedisEmailKey, user)
+
+	token, err := setEmail(redisClient, user, "cool@example.com")
+	if err != nil {
+		t.Fatalf("couldn't set email: %s", err)
+	}
+	protect := csrf.Protect([]byte("32-byte-long-csrf-authentication"))
+	serve := func(handler HandlerFunc, method, target string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, strings.NewReader("List-Unsubscribe=One-Click"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		SkipEmailCSRF(protect(&Endpoint{HandlerFunc: handler, ErrorTmpl: errTmpl, Logger: logger})).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Following the confirm link only shows a form.
+	confirmTarget := "/email/confirm?" + url.Values{"user": {user}, "token": {token}}.Encode()
+	if code := serve(ConfirmEmailPage(emailTmpl, redisClient, logger), "GET", confirmTarget); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if s.HGet(key, emailConfirmTokenField) != token {
+		t.Errorf("expected the email to still need confirming")
+	}
+	// Confirming still needs a CSRF token.
+	if code := serve(ConfirmEmail(errTmpl, redisClient, logger), "POST", confirmTarget); code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, code)
+	}
+	if code := serve(ConfirmEmailPage(emailTmpl, redisClient, logger), "GET", "/email/confirm?user=coolkid99&token=wrong"); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for a wrong token, got %d", http.StatusBadRequest, code)
+	}
+
+	unsubscribeTarget := EmailUnsubscribePath + "?" + url.Values{"user": {user}, "token": {s.HGet(key, emailUnsubscribeTokenField)}}.Encode()
+	if code := serve(UnsubscribeEmailPage(emailTmpl, redisClient, logger), "GET", unsubscribeTarget); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if !s.Exists(key) {
+		t.Fatalf("expected the unsubscribe page not to remove the email")
+	}
+	// Mail clients can unsubscribe in one click, without a CSRF token.
+	if code := serve(UnsubscribeEmail(errTmpl, redisClient, logger), "POST", unsubscribeTarget); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if s.Exists(key) {
+		t.Errorf("expected the email to be removed")
+	}
+}
+
+func TestSetEmailCooldown(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	RegisterGobEncodings()
+	store := sessions.NewCookieStore([]byte("authentication-key"))
+	mailer := NewMailer("127.0.0.1:25", "", "", "noreply@example.com", "https://example.com", redisClient, logger)
+	handler := SetEmail(store, redisClient, mailer, logger)
+	user := "coolkid99"
+	set := func(address string) error {
+		r := loggedInRequest(t, store, "POST", "/settings/email", url.Values{"email": {address}}.Encode(), user)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return handler(httptest.NewRecorder(), r)
+	}
+
+	if err = set("cool@example.com"); err != nil {
+		t.Fatalf("couldn't set email: %s", err)
+	}
+	if err = set("other@example.com"); err != ErrEmailCooldown {
+		t.Fatalf("expected %s, got %v", ErrEmailCooldown, err)
+	}
+	settings, err := getEmailSettings(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't get email settings: %s", err)
+	}
+	if settings.Address != "cool@example.com" {
+		t.Errorf("expected the address not to change during the cooldown, got %s", settings.Address)
+	}
+	if n, _ := s.ZMembers(RedisEmailQueueKey); len(n) != 1 {
+		t.Errorf("expected 1 confirmation email queued, got %d", len(n))
+	}
+
+	s.FastForward(emailConfirmCooldown)
+	if err = set("other@example.com"); err != nil {
+		t.Fatalf("couldn't set email after the cooldown: %s", err)
+	}
+}
@@ -1,13 +1,17 @@
 package spotshot
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"html/template"
-	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/gorilla/csrf"
@@ -22,13 +26,19 @@ type SessionKey int
 const (
 	SpotifyState SessionKey = iota
 	SpotifyUserID
+	// IsSubscribed is no longer used. Subscriptions are looked up in Redis.
 	IsSubscribed
 	IsLoggedIn
+	SpotifyStateExpiry
+	SpotifyCodeVerifier
+	// SessionRenewedAt is the Unix time RenewSessions last saved the session.
+	SessionRenewedAt
 )
 
 const (
-	alphanumChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ01234567890"
-	SessionName   = "session"
+	SessionName = "session"
+	// stateLifetime is how long a user has to log in with Spotify.
+	stateLifetime = 10 * time.Minute
 )
 
 func RegisterGobEncodings() {
@@ -38,22 +48,63 @@ func RegisterGobEncodings() {
 
 type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
 
+// Endpoint serves a HandlerFunc. If the handler fails, the client gets an
+// error page with a status matching the kind of error, or a JSON problem
+// document if they asked for JSON.
 type Endpoint struct {
 	HandlerFunc
-	Logger logrus.FieldLogger
+	ErrorTmpl *template.Template
+	Logger    logrus.FieldLogger
 }
 
 func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err := e.HandlerFunc(w, r)
+	if err == nil {
+		return
+	}
+	logger := RequestLogger(r, e.Logger)
+	httpErr := classifyError(err)
+	logError(logger, httpErr, err)
+	if acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(httpErr.Status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":   "about:blank",
+			"title":  http.StatusText(httpErr.Status),
+			"status": httpErr.Status,
+			"detail": httpErr.Message,
+			"code":   httpErr.Code,
+		})
+		return
+	}
+	if e.ErrorTmpl == nil {
+		http.Error(w, httpErr.Message, httpErr.Status)
+		return
+	}
+	err = renderError(w, e.ErrorTmpl, httpErr.Status, http.StatusText(httpErr.Status), httpErr.Message)
 	if err != nil {
-		e.Logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		logger.Errorf("couldn't render error page: %s", err)
+	}
+}
+
+// logError logs client errors at a lower level than server faults.
+func logError(logger logrus.FieldLogger, httpErr httpError, err error) {
+	if httpErr.Status >= http.StatusInternalServerError {
+		logger.Error(err)
+	} else {
+		logger.Info(err)
 	}
 }
 
-func Home(homeTmpl *template.Template, store sessions.Store, logger logrus.FieldLogger) HandlerFunc {
+// acceptsJSON reports whether the client would rather have JSON than HTML.
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "json") && !strings.Contains(accept, "text/html")
+}
+
+func Home(homeTmpl *template.Template, store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
 		// Fetch session (or create new one if need be).
 		session, err := store.Get(r, SessionName)
 		if err != nil {
@@ -64,15 +115,24 @@ func Home(homeTmpl *template.Template, store sessions.Store, logger logrus.Field
 			"IsLoggedIn": isLoggedIn(session),
 			"CSRFField":  csrf.TemplateField(r),
 		}
-		data["IsSubscribed"], _ = session.Values[IsSubscribed].(bool)
+		if userID, ok := session.Values[SpotifyUserID].(string); ok && isLoggedIn(session) {
+			sub, err := getSubscription(redisClient, userID)
+			if err != nil {
+				return err
+			}
+			data["IsSubscribed"] = sub.Subscribed
+			// Let the user know if we've lost access to their Spotify account.
+			data["NeedsReauth"] = sub.NeedsReauth
+		}
 		w.WriteHeader(200)
 		homeTmpl.Execute(w, data)
 		return nil
 	}
 }
 
-func SpotifyLogin(auth spotify.Authenticator, store sessions.Store, logger logrus.FieldLogger) HandlerFunc {
+func SpotifyLogin(auth Authenticator, store sessions.Store, logger logrus.FieldLogger) HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
 		// Fetch session (or create new one if need be).
 		session, err := store.Get(r, SessionName)
 		if err != nil {
@@ -80,8 +140,19 @@ func SpotifyLogin(auth spotify.Authenticator, store sessions.Store, logger logru
 		}
 
 		// Generate random state string and store in session to check later in Callback.
-		state := randAlphanumStr(10)
+		state, err := randToken(32)
+		if err != nil {
+			return fmt.Errorf("couldn't generate state: %w", err)
+		}
 		session.Values[SpotifyState] = state
+		session.Values[SpotifyStateExpiry] = timeNow().Add(stateLifetime).Unix()
+		// Generate a PKCE code verifier, which proves to Spotify in Callback
+		// that we're the ones who started the login.
+		codeVerifier, err := newCodeVerifier()
+		if err != nil {
+			return fmt.Errorf("couldn't generate code verifier: %w", err)
+		}
+		session.Values[SpotifyCodeVerifier] = codeVerifier
 
 		err = session.Save(r, w)
 		if err != nil {
@@ -89,53 +160,68 @@ func SpotifyLogin(auth spotify.Authenticator, store sessions.Store, logger logru
 		}
 
 		// Redirect user to authenticate with Spotify.
-		url := auth.AuthURL(state)
+		url := auth.AuthURL(state, codeVerifier)
 		http.Redirect(w, r, url, http.StatusFound)
 		return nil
 	}
 }
 
-func Callback(auth spotify.Authenticator, store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+func Callback(auth Authenticator, store sessions.Store, redisClient redis.UniversalClient, notifier Notifier, logger logrus.FieldLogger) HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
 		// Fetch session.
 		session, err := store.Get(r, SessionName)
 		if err != nil {
 			logger.Warn(SessionFetchError{err})
 		}
-		state, ok := session.Values[SpotifyState].(string)
-		if !ok {
-			if _, ok = session.Values[SpotifyState]; !ok {
-				return ErrStateNotSet
-			}
-			return ErrStateUnexpectedType
+		// Check the state we were given matches the one in the session. The
+		// state is removed from the session straight away so it can only be
+		// used once.
+		state, codeVerifier, err := popState(session)
+		if err == nil && subtle.ConstantTimeCompare([]byte(state), []byte(r.URL.Query().Get("state"))) != 1 {
+			err = ErrStateMismatch
+		}
+		if saveErr := session.Save(r, w); saveErr != nil {
+			return fmt.Errorf("couldn't save session: %w", saveErr)
+		}
+		if err != nil {
+			return err
 		}
 
 		// auth.Token uses the code in query params to get an OAuth token
 		// from the Spotify API.
-		token, err := auth.Token(state, r)
+		token, err := auth.Token(r, codeVerifier)
 		if err != nil {
 			return fmt.Errorf("couldn't get token: %w", err)
 		}
 		// Get user details with the new token.
-		client := auth.NewClient(token)
+		client, err := auth.NewClient(token)
+		if err != nil {
+			return fmt.Errorf("couldn't make spotify client: %w", err)
+		}
 		user, err := client.CurrentUser()
 		if err != nil {
-			return fmt.Errorf("err fetching curr user info: %s", err)
+			return fmt.Errorf("err fetching curr user info: %w", err)
 		}
+		logger = setRequestUser(r, logger, user.ID)
 		// Store user ID in session. We'll use this later to fetch other details from Redis.
 		session.Values[SpotifyUserID] = user.ID
-		// Set in session if they are subscribed or not.
 		key := fmt.Sprintf("%s:%s", RedisUserIDKey, user.ID)
-		session.Values[IsSubscribed], err = redisClient.HExists(key, NumSongsField).Result()
-		if err != nil {
-			return fmt.Errorf("couldn't get num songs: %w", err)
-		}
 
 		// Set refresh token in Redis.
 		err = redisClient.HSet(key, RefreshTokenField, token.RefreshToken).Err()
 		if err != nil {
 			return fmt.Errorf("error while setting redis key %s: %w", RefreshTokenField, err)
 		}
+		// A new refresh token means we're authorized again.
+		reauthed, err := redisClient.HDel(key, NeedsReauthField, ReauthPeriodField).Result()
+		if err != nil {
+			return fmt.Errorf("couldn't delete redis field %s in key %s: %w", NeedsReauthField, key, err)
+		}
+		if reauthed > 0 {
+			logger.Info("reauthorized")
+			notifySubscriptionChanged(notifier, redisClient, user.ID, logger)
+		}
 
 		session.Values[IsLoggedIn] = true
 
@@ -143,6 +229,12 @@ func Callback(auth spotify.Authenticator, store sessions.Store, redisClient redi
 		if err != nil {
 			return fmt.Errorf("couldn't save session: %w", err)
 		}
+		// Remember the session so it can be removed if the user deletes their data.
+		sessionsKey := fmt.Sprintf("%s:%s", RedisSessionsKey, user.ID)
+		err = redisClient.SAdd(sessionsKey, session.ID).Err()
+		if err != nil {
+			return fmt.Errorf("couldn't add to redis key %s: %w", sessionsKey, err)
+		}
 
 		http.Redirect(w, r, "/", http.StatusFound)
 		return nil
@@ -151,6 +243,7 @@ func Callback(auth spotify.Authenticator, store sessions.Store, redisClient redi
 
 func Logout(store sessions.Store, logger logrus.FieldLogger) HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
 		// Fetch session.
 		session, err := store.Get(r, SessionName)
 		if err != nil {
@@ -172,8 +265,9 @@ func Logout(store sessions.Store, logger logrus.FieldLogger) HandlerFunc {
 	}
 }
 
-func Subscribe(store sessions.Store, redisClient redis.UniversalClient, playlistNowCh chan<- spotify.ID, logger logrus.FieldLogger) HandlerFunc {
+func Subscribe(store sessions.Store, redisClient redis.UniversalClient, playlistNowCh chan<- PlaylistJob, notifier Notifier, logger logrus.FieldLogger) HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
 		// Fetch session.
 		session, err := store.Get(r, SessionName)
 		if err != nil {
@@ -183,13 +277,11 @@ func Subscribe(store sessions.Store, redisClient redis.UniversalClient, playlist
 			return ErrNotLoggedIn
 		}
 		// Get user ID from session.
-		userID, ok := session.Values[SpotifyUserID].(string)
-		if !ok {
-			if _, ok = session.Values[SpotifyUserID]; !ok {
-				return ErrUserIDNotSet
-			}
-			return UserIDUnexpectedTypeError{session.Values[SpotifyUserID]}
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
 		}
+		logger = setRequestUser(r, logger, userID)
 
 		// Parse num_songs from form data.
 		nStr := r.FormValue("num_songs")
@@ -200,48 +292,61 @@ func Subscribe(store sessions.Store, redisClient redis.UniversalClient, playlist
 		if err != nil {
 			return fmt.Errorf("couldn't convert num_songs to int: %w", err)
 		}
-		if n > 50 {
-			n = 50
-		}
-		isPrivate := true
-		if r.FormValue("is_private") == "" {
-			isPrivate = false
+		isPrivate := r.FormValue("is_private") != ""
+
+		err = subscribe(redisClient, userID, n, isPrivate)
+		if err != nil {
+			return err
 		}
+		logger.Infof("subscribed")
+		notifySubscriptionChanged(notifier, redisClient, userID, logger)
 
-		HSetIfNoErr := func(key string, field string, value interface{}) {
-			if err == nil {
-				err = redisClient.HSet(key, field, value).Err()
+		if r.FormValue("playlist_now") != "" {
+			err = queuePlaylistJob(redisClient, playlistNowCh, PlaylistJob{UserID: spotify.ID(userID), RequestID: RequestID(r)})
+			if err != nil {
+				return err
 			}
 		}
-		key := fmt.Sprintf("%s:%s", RedisUserIDKey, userID)
-		HSetIfNoErr(key, NumSongsField, n)
-		// Redis doesn't have booleans. Let's just have the existence of the key indicate true.
-		if isPrivate {
-			HSetIfNoErr(key, IsPrivateField, "")
-		}
-		if err != nil {
-			return fmt.Errorf("error while setting redis key: %w", err)
-		}
 
-		session.Values[IsSubscribed] = true
-		logger.WithField("user_id", userID).Infof("subscribed")
+		http.Redirect(w, r, r.Referer(), http.StatusFound)
+		return nil
+	}
+}
 
-		if r.FormValue("playlist_now") != "" {
-			playlistNowCh <- spotify.ID(userID)
+func Unsubscribe(store sessions.Store, redisClient redis.UniversalClient, notifier Notifier, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
 		}
+		logger = setRequestUser(r, logger, userID)
 
-		err = session.Save(r, w)
+		err = unsubscribe(redisClient, userID)
 		if err != nil {
-			return fmt.Errorf("couldn't save session: %w", err)
+			return err
 		}
+		logger.Infof("unsubscribed")
+		notifySubscriptionChanged(notifier, redisClient, userID, logger)
 
 		http.Redirect(w, r, r.Referer(), http.StatusFound)
 		return nil
 	}
 }
 
-func Unsubscribe(store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+// ExportData sends the user everything Spotshot stores about them as a JSON download.
+func ExportData(store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
 		// Fetch session.
 		session, err := store.Get(r, SessionName)
 		if err != nil {
@@ -251,40 +356,227 @@ func Unsubscribe(store sessions.Store, redisClient redis.UniversalClient, logger
 			return ErrNotLoggedIn
 		}
 		// Get user ID from session.
-		userID, ok := session.Values[SpotifyUserID].(string)
-		if !ok {
-			if _, ok = session.Values[SpotifyUserID]; !ok {
-				return ErrUserIDNotSet
-			}
-			return UserIDUnexpectedTypeError{session.Values[SpotifyUserID]}
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
 		}
+		logger = setRequestUser(r, logger, userID)
 
 		key := fmt.Sprintf("%s:%s", RedisUserIDKey, userID)
-		err = redisClient.HDel(key, NumSongsField).Err()
+		fields, err := redisClient.HGetAll(key).Result()
+		if err != nil {
+			return fmt.Errorf("couldn't get redis key %s: %w", key, err)
+		}
+		// The refresh token is a credential, so only say that we have it.
+		if _, ok := fields[RefreshTokenField]; ok {
+			fields[RefreshTokenField] = "[redacted]"
+		}
+		snapshots, err := Snapshots(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		jobs, err := Jobs(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		tokens, err := APITokens(redisClient, userID)
 		if err != nil {
-			return fmt.Errorf("couldn't delete redis field %s in key %s: %w", NumSongsField, key, err)
+			return err
+		}
+		email, err := getEmailSettings(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		webhooks, err := Webhooks(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		webhookLog, err := WebhookLog(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		feed, err := feedToken(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		public, err := getPublicSettings(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		sessionsKey := fmt.Sprintf("%s:%s", RedisSessionsKey, userID)
+		numSessions, err := redisClient.SCard(sessionsKey).Result()
+		if err != nil {
+			return fmt.Errorf("couldn't get redis key %s: %w", sessionsKey, err)
 		}
 
-		session.Values[IsSubscribed] = false
-		logger.WithField("user_id", userID).Infof("unsubscribed")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="spotshot-%s.json"`, userID))
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]interface{}{
+			"user_id":     userID,
+			"user":        fields,
+			"snapshots":   snapshots,
+			"jobs":        jobs,
+			"sessions":    numSessions,
+			"tokens":      tokens,
+			"email":       email,
+			"webhooks":    webhooks,
+			"webhook_log": webhookLog,
+			"feed_token":  feed,
+			"public":      public,
+		})
+	}
+}
+
+// DeleteData removes everything Spotshot stores about the user and logs them out.
+// Spotify has no endpoint for revoking a token, so forgetting the refresh token
+// is as far as we can go. Users can remove access from their Spotify account page.
+func DeleteData(store *RedisStore, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
 
+		// Remove every session the user has logged in with.
+		sessionsKey := fmt.Sprintf("%s:%s", RedisSessionsKey, userID)
+		sessionIDs, err := redisClient.SMembers(sessionsKey).Result()
+		if err != nil {
+			return fmt.Errorf("couldn't get redis key %s: %w", sessionsKey, err)
+		}
+		err = store.Delete(sessionIDs...)
+		if err != nil {
+			return err
+		}
+		tokens, err := APITokens(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		tokenIDs := make([]string, len(tokens))
+		for i, token := range tokens {
+			tokenIDs[i] = token.ID
+		}
+		err = revokeAPITokens(redisClient, userID, tokenIDs...)
+		if err != nil {
+			return err
+		}
+		// Free up their handle.
+		err = deletePublicSettings(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		err = unsubscribe(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		err = deleteKeys(redisClient, userDataKeys(userID)...)
+		if err != nil {
+			return fmt.Errorf("couldn't delete user data: %w", err)
+		}
+		logger.Infof("deleted data")
+
+		// Delete this session too, which also clears the cookie.
+		session.Options.MaxAge = -1
 		err = session.Save(r, w)
 		if err != nil {
 			return fmt.Errorf("couldn't save session: %w", err)
 		}
 
-		http.Redirect(w, r, r.Referer(), http.StatusFound)
+		http.Redirect(w, r, "/", http.StatusFound)
 		return nil
 	}
 }
 
-func randAlphanumStr(n int) string {
-	var sb strings.Builder
-	for i := 0; i < n; i++ {
-		r := rand.Intn(len(alphanumChars))
-		sb.WriteByte(alphanumChars[r])
+// userDataKeys returns the Redis keys holding data about the user.
+func userDataKeys(userID string) []string {
+	return []string{
+		fmt.Sprintf("%s:%s", RedisUserIDKey, userID),
+		fmt.Sprintf("%s:%s", RedisHistoryKey, userID),
+		fmt.Sprintf("%s:%s", RedisJobsKey, userID),
+		fmt.Sprintf("%s:%s", RedisSessionsKey, userID),
+		fmt.Sprintf("%s:%s", RedisUserTokensKey, userID),
+		fmt.Sprintf("%s:%s", RedisEmailKey, userID),
+		fmt.Sprintf("%s:%s", RedisEmailCooldownKey, userID),
+		fmt.Sprintf("%s:%s", RedisWebhooksKey, userID),
+		fmt.Sprintf("%s:%s", RedisWebhookLogKey, userID),
+		fmt.Sprintf("%s:%s", RedisFeedTokenKey, userID),
+		fmt.Sprintf("%s:%s", RedisPublicKey, userID),
+		fmt.Sprintf("%s:%s", RedisShareCardKey, userID),
+		fmt.Sprintf("%s:%s", RedisQueuedKey, userID),
+	}
+}
+
+func sessionUserID(session *sessions.Session) (string, error) {
+	userID, ok := session.Values[SpotifyUserID].(string)
+	if !ok {
+		if _, ok = session.Values[SpotifyUserID]; !ok {
+			return "", ErrUserIDNotSet
+		}
+		return "", UserIDUnexpectedTypeError{session.Values[SpotifyUserID]}
+	}
+	return userID, nil
+}
+
+// popState removes the OAuth state and PKCE code verifier from the session and
+// returns them if they haven't expired.
+func popState(session *sessions.Session) (string, string, error) {
+	stateVal, stateOK := session.Values[SpotifyState]
+	expiryVal, expiryOK := session.Values[SpotifyStateExpiry]
+	verifierVal, verifierOK := session.Values[SpotifyCodeVerifier]
+	delete(session.Values, SpotifyState)
+	delete(session.Values, SpotifyStateExpiry)
+	delete(session.Values, SpotifyCodeVerifier)
+	if !stateOK || !expiryOK || !verifierOK {
+		return "", "", ErrStateNotSet
+	}
+	state, ok := stateVal.(string)
+	if !ok {
+		return "", "", ErrStateUnexpectedType
+	}
+	expiry, ok := expiryVal.(int64)
+	if !ok {
+		return "", "", ErrStateUnexpectedType
+	}
+	codeVerifier, ok := verifierVal.(string)
+	if !ok {
+		return "", "", ErrStateUnexpectedType
+	}
+	if timeNow().Unix() > expiry {
+		return "", "", ErrStateExpired
+	}
+	return state, codeVerifier, nil
+}
+
+// renderError writes an error page with the given status.
+func renderError(w http.ResponseWriter, errTmpl *template.Template, status int, title, message string) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	return errTmpl.Execute(w, map[string]interface{}{
+		"Title":   title,
+		"Message": message,
+	})
+}
+
+// randToken returns a URL-safe string encoding n bytes from a secure random source.
+func randToken(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
 	}
-	return sb.String()
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 func isLoggedIn(session *sessions.Session) bool {
@@ -3,6 +3,10 @@ package spotshot
 import (
 	"errors"
 	"fmt"
+	"net/http"
+
+	"github.com/zmb3/spotify"
+	"golang.org/x/oauth2"
 )
 
 type SessionFetchError struct {
@@ -21,6 +25,43 @@ func (e ExpectedFormValueError) Error() string {
 	return fmt.Sprintf("expected form value for %s", e.Key)
 }
 
+type InvalidValueError struct {
+	Key   string
+	Value interface{}
+}
+
+func (e InvalidValueError) Error() string {
+	return fmt.Sprintf("invalid value for %s: %v", e.Key, e.Value)
+}
+
+type MalformedBodyError struct {
+	Err error
+}
+
+func (e MalformedBodyError) Error() string {
+	return fmt.Sprintf("couldn't decode request body: %s", e.Err)
+}
+
+func (e MalformedBodyError) Unwrap() error {
+	return e.Err
+}
+
+type InsufficientScopeError struct {
+	Scope string
+}
+
+func (e InsufficientScopeError) Error() string {
+	return fmt.Sprintf("token doesn't have the %s scope", e.Scope)
+}
+
+type SpotifyAuthError struct {
+	Reason string
+}
+
+func (e SpotifyAuthError) Error() string {
+	return fmt.Sprintf("spotify: auth failed - %s", e.Reason)
+}
+
 type UserIDUnexpectedTypeError struct {
 	ID interface{}
 }
@@ -31,8 +72,84 @@ func (e UserIDUnexpectedTypeError) Error() string {
 
 var (
 	ErrNotLoggedIn         = errors.New("user not logged in")
+	ErrNotSubscribed       = errors.New("user not subscribed")
+	ErrNotAdmin            = errors.New("user not an admin")
+	ErrInvalidEmailToken   = errors.New("invalid or expired email token")
+	ErrEmailDisabled       = errors.New("email isn't configured")
+	ErrEmailCooldown       = errors.New("confirmation email sent recently")
+	ErrWebhookNotFound     = errors.New("webhook not found")
+	ErrTooManyWebhooks     = errors.New("user has too many webhooks")
+	ErrFeedNotFound        = errors.New("feed not found or token invalid")
+	ErrPageNotFound        = errors.New("public page not found")
+	ErrSnapshotNotFound    = errors.New("snapshot not found")
+	ErrJobQueued           = errors.New("user already has a job queued")
+	ErrQueueFull           = errors.New("job queue is full")
+	ErrHandleTaken         = errors.New("handle is taken by another user")
+	ErrInvalidToken        = errors.New("invalid or expired API token")
 	ErrUserIDNotSet        = errors.New("no user ID found in session")
 	ErrStateNotSet         = errors.New("no state found in session")
 	ErrStateUnexpectedType = errors.New("state found with unexpected type")
 	ErrStateMismatch       = errors.New("state in query and session are different")
+	ErrStateExpired        = errors.New("state in session has expired")
 )
+
+// httpError is how an error is shown to clients.
+type httpError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// classifyError maps err to the status, code and message clients see. Errors
+// that aren't recognised are server faults, whose details are kept private.
+func classifyError(err error) httpError {
+	var formErr ExpectedFormValueError
+	var valueErr InvalidValueError
+	var bodyErr MalformedBodyError
+	var scopeErr InsufficientScopeError
+	var authErr SpotifyAuthError
+	var spotErr spotify.Error
+	var retrieveErr *oauth2.RetrieveError
+	switch {
+	case errors.Is(err, ErrNotLoggedIn), errors.Is(err, ErrUserIDNotSet):
+		return httpError{http.StatusUnauthorized, "not_logged_in", "You need to log in first."}
+	case errors.Is(err, ErrInvalidToken):
+		return httpError{http.StatusUnauthorized, "invalid_token", "The API token is invalid or has expired."}
+	case errors.As(err, &scopeErr):
+		return httpError{http.StatusForbidden, "insufficient_scope", fmt.Sprintf("The API token doesn't have the %s scope.", scopeErr.Scope)}
+	case errors.Is(err, ErrNotAdmin):
+		return httpError{http.StatusForbidden, "forbidden", "You don't have access to this page."}
+	case errors.Is(err, ErrInvalidEmailToken):
+		return httpError{http.StatusBadRequest, "invalid_email_token", "The link is invalid or has expired."}
+	case errors.Is(err, ErrEmailDisabled):
+		return httpError{http.StatusBadRequest, "email_disabled", "Emails aren't available on this Spotshot."}
+	case errors.Is(err, ErrEmailCooldown):
+		return httpError{http.StatusTooManyRequests, "email_cooldown", "We've just sent you a confirmation email. Please wait a few minutes before asking for another."}
+	case errors.Is(err, ErrTooManyWebhooks):
+		return httpError{http.StatusBadRequest, "too_many_webhooks", fmt.Sprintf("You can't have more than %d webhooks.", maxWebhooks)}
+	case errors.Is(err, ErrFeedNotFound):
+		return httpError{http.StatusNotFound, "feed_not_found", "There's no feed here. The link may have been reset."}
+	case errors.Is(err, ErrPageNotFound):
+		return httpError{http.StatusNotFound, "not_found", "There's no page here."}
+	case errors.Is(err, ErrSnapshotNotFound):
+		return httpError{http.StatusNotFound, "snapshot_not_found", "You don't have a playlist for that period."}
+	case errors.Is(err, ErrJobQueued):
+		return httpError{http.StatusTooManyRequests, "already_queued", "You already have a playlist on the way. Please wait for it before asking for another."}
+	case errors.Is(err, ErrQueueFull):
+		return httpError{http.StatusServiceUnavailable, "queue_full", "Spotshot is busy making playlists. Please try again later."}
+	case errors.Is(err, ErrHandleTaken):
+		return httpError{http.StatusConflict, "handle_taken", "Someone else already has that name. Please pick another."}
+	case errors.Is(err, ErrNotSubscribed):
+		return httpError{http.StatusConflict, "not_subscribed", "You need to subscribe first."}
+	case errors.Is(err, ErrStateNotSet), errors.Is(err, ErrStateUnexpectedType),
+		errors.Is(err, ErrStateMismatch), errors.Is(err, ErrStateExpired):
+		return httpError{http.StatusBadRequest, "invalid_state", "Your login attempt was invalid or took too long. Please try logging in again."}
+	case errors.As(err, &authErr):
+		return httpError{http.StatusBadRequest, "spotify_auth_failed", "Logging in with Spotify was cancelled or didn't work. Please try again."}
+	case errors.As(err, &formErr), errors.As(err, &valueErr), errors.As(err, &bodyErr):
+		return httpError{http.StatusBadRequest, "invalid_request", err.Error()}
+	case errors.As(err, &spotErr), errors.As(err, &retrieveErr):
+		return httpError{http.StatusBadGateway, "spotify_error", "Spotify returned an error. Please try again later."}
+	}
+	return httpError{http.StatusInternalServerError, "internal_error", "Something went wrong on our end."}
+}
@@ -0,0 +1,82 @@
+package spotshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{ErrNotLoggedIn, http.StatusUnauthorized},
+		{fmt.Errorf("wrapped: %w", ErrInvalidToken), http.StatusUnauthorized},
+		{InsufficientScopeError{ScopeWrite}, http.StatusForbidden},
+		{ExpectedFormValueError{"num_songs"}, http.StatusBadRequest},
+		{ErrStateMismatch, http.StatusBadRequest},
+		{ErrNotSubscribed, http.StatusConflict},
+		{fmt.Errorf("err fetching curr user info: %w", spotify.Error{Status: 500}), http.StatusBadGateway},
+		{errors.New("redis is down"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if got := classifyError(test.err).Status; got != test.status {
+			t.Errorf("expected status %d for %q, got %d", test.status, test.err, got)
+		}
+	}
+}
+
+func TestEndpointErrors(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	errTmpl := template.Must(template.New("error").Parse("<h1>{{ .Title }}</h1><p>{{ .Message }}</p>"))
+	e := &Endpoint{
+		HandlerFunc: func(w http.ResponseWriter, r *http.Request) error {
+			return ErrNotLoggedIn
+		},
+		ErrorTmpl: errTmpl,
+		Logger:    logger,
+	}
+
+	// Browsers get an error page.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/subscribe", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "<h1>Unauthorized</h1>") {
+		t.Errorf("expected error page, got %s", w.Body)
+	}
+
+	// Clients asking for JSON get a problem document.
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/subscribe", nil)
+	r.Header.Set("Accept", "application/json")
+	e.ServeHTTP(w, r)
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("expected problem document, got content type %s", ct)
+	}
+	var problem struct {
+		Status int
+		Code   string
+	}
+	err := json.NewDecoder(w.Body).Decode(&problem)
+	if err != nil {
+		t.Fatalf("couldn't decode problem document: %s", err)
+	}
+	if problem.Status != http.StatusUnauthorized || problem.Code != "not_logged_in" {
+		t.Errorf("expected not_logged_in problem with status %d, got %+v", http.StatusUnauthorized, problem)
+	}
+}
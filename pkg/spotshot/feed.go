@@ -0,0 +1,198 @@
+package spotshot
+
+import (
+	"crypto/subtle"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	RedisFeedTokenKey = "spot_usr_feed"
+
+	// maxFeedEntries is how many of the most recent snapshots are in feeds.
+	maxFeedEntries = 50
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// feedToken returns the token in the user's feed URL, or an empty string if
+// they haven't turned their feed on.
+func feedToken(redisClient redis.UniversalClient, userID string) (string, error) {
+	key := fmt.Sprintf("%s:%s", RedisFeedTokenKey, userID)
+	token, err := redisClient.Get(key).Result()
+	if err != nil && err != redis.Nil {
+		return "", fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	return token, nil
+}
+
+// resetFeedToken gives the user's feed a new token, so only people with the
+// new URL can read it.
+func resetFeedToken(redisClient redis.UniversalClient, userID string) (string, error) {
+	token, err := randToken(32)
+	if err != nil {
+		return "", fmt.Errorf("couldn't generate token: %w", err)
+	}
+	key := fmt.Sprintf("%s:%s", RedisFeedTokenKey, userID)
+	err = redisClient.Set(key, token, 0).Err()
+	if err != nil {
+		return "", fmt.Errorf("error while setting redis key %s: %w", key, err)
+	}
+	return token, nil
+}
+
+// feedURL is the path of the user's feed.
+func feedURL(userID, token string) string {
+	return "/feed?" + url.Values{"user": {userID}, "token": {token}}.Encode()
+}
+
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// newAtomFeed makes a feed with an entry for each snapshot, newest first.
+func newAtomFeed(userID string, snapshots []Snapshot) *atomFeed {
+	feed := &atomFeed{
+		ID:     fmt.Sprintf("urn:spotshot:feed:%s", userID),
+		Title:  fmt.Sprintf("Spotshot playlists for %s", userID),
+		Author: atomPerson{Name: userID},
+		Link:   atomLink{Rel: "alternate", Href: fmt.Sprintf("https://open.spotify.com/user/%s", url.PathEscape(userID))},
+	}
+	for i := len(snapshots) - 1; i >= 0 && len(feed.Entries) < maxFeedEntries; i-- {
+		s := &snapshots[i]
+		var content strings.Builder
+		fmt.Fprintf(&content, "<p>Your top songs for %s.</p>\n<ol>\n", html.EscapeString(s.Period))
+		for _, track := range s.Tracks {
+			fmt.Fprintf(&content, "<li><a href=\"%s\">%s</a> by %s</li>\n",
+				html.EscapeString(track.URL()), html.EscapeString(track.Name), html.EscapeString(track.ArtistNames()))
+		}
+		content.WriteString("</ol>\n")
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      fmt.Sprintf("urn:spotshot:snapshot:%s:%s", userID, s.PlaylistID),
+			Title:   s.Name,
+			Updated: atomTime(s.CreatedAt),
+			Link:    atomLink{Rel: "alternate", Href: s.PlaylistURL()},
+			Content: atomContent{Type: "html", Body: content.String()},
+		})
+	}
+	if len(feed.Entries) > 0 {
+		feed.Updated = feed.Entries[0].Updated
+	} else {
+		feed.Updated = atomTime(time.Unix(0, 0))
+	}
+	return feed
+}
+
+// Feed serves an Atom feed of the user's snapshots. It's authenticated by the
+// token in the URL rather than a session, so feed readers can fetch it.
+func Feed(redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		userID := r.FormValue("user")
+		token, err := feedToken(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(r.FormValue("token"))) != 1 {
+			return ErrFeedNotFound
+		}
+		setRequestUser(r, logger, userID)
+
+		snapshots, err := Snapshots(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		b, err := xml.MarshalIndent(newAtomFeed(userID, snapshots), "", "  ")
+		if err != nil {
+			return fmt.Errorf("couldn't encode feed: %w", err)
+		}
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(append([]byte(xml.Header), b...))
+		return err
+	}
+}
+
+// SetFeed turns the user's feed on with a new URL, or off, depending on the
+// enabled form value.
+func SetFeed(store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
+
+		switch enabled := r.FormValue("enabled"); enabled {
+		case "true":
+			_, err = resetFeedToken(redisClient, userID)
+			if err != nil {
+				return err
+			}
+			logger.Info("reset feed URL")
+		case "false":
+			key := fmt.Sprintf("%s:%s", RedisFeedTokenKey, userID)
+			err = redisClient.Del(key).Err()
+			if err != nil {
+				return fmt.Errorf("couldn't delete redis key %s: %w", key, err)
+			}
+			logger.Info("turned off feed")
+		case "":
+			return ExpectedFormValueError{"enabled"}
+		default:
+			return InvalidValueError{"enabled", enabled}
+		}
+
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+}
@@ -0,0 +1,83 @@
+package spotshot
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFeed(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	user := "coolkid99"
+	handler := Feed(redisClient, logrus.New())
+
+	r := httptest.NewRequest("GET", "/feed?user=coolkid99&token=", nil)
+	err = handler(httptest.NewRecorder(), r)
+	if !errors.Is(err, ErrFeedNotFound) {
+		t.Errorf("expected ErrFeedNotFound before the feed is turned on, got %v", err)
+	}
+
+	for _, snapshot := range []*Snapshot{
+		{Period: "2019-07", PlaylistID: "jul", Name: "Your Top Songs Jul 19", CreatedAt: time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC)},
+		{Period: "2019-08", PlaylistID: "aug", Name: "Your Top Songs Aug 19", CreatedAt: time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC),
+			Tracks: []SnapshotTrack{{ID: "t1", Name: "<Song>", Artists: []SnapshotArtist{{Name: "Tom & Jerry"}}}}},
+	} {
+		err = saveSnapshot(redisClient, user, snapshot)
+		if err != nil {
+			t.Fatalf("couldn't save snapshot: %s", err)
+		}
+	}
+	token, err := resetFeedToken(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't reset feed token: %s", err)
+	}
+
+	r = httptest.NewRequest("GET", "/feed?user=coolkid99&token=wrong", nil)
+	err = handler(httptest.NewRecorder(), r)
+	if !errors.Is(err, ErrFeedNotFound) {
+		t.Errorf("expected ErrFeedNotFound for the wrong token, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r = httptest.NewRequest("GET", feedURL(user, token), nil)
+	err = handler(w, r)
+	if err != nil {
+		t.Fatalf("feed failed: %s", err)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/atom+xml") {
+		t.Errorf("expected atom content type, got %s", ct)
+	}
+	var feed atomFeed
+	err = xml.Unmarshal(w.Body.Bytes(), &feed)
+	if err != nil {
+		t.Fatalf("couldn't decode feed: %s", err)
+	}
+	if len(feed.Entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(feed.Entries))
+	}
+	entry := feed.Entries[0]
+	if entry.Title != "Your Top Songs Aug 19" || entry.Link.Href != "https://open.spotify.com/playlist/aug" {
+		t.Errorf("expected newest snapshot first, got %+v", entry)
+	}
+	if feed.Updated != "2019-09-01T00:00:00Z" {
+		t.Errorf("expected feed to be updated at the newest snapshot, got %s", feed.Updated)
+	}
+	if !strings.Contains(entry.Content.Body, "2019-08") ||
+		!strings.Contains(entry.Content.Body, `<a href="https://open.spotify.com/track/t1">&lt;Song&gt;</a> by Tom &amp; Jerry`) {
+		t.Errorf("unexpected entry content: %s", entry.Content.Body)
+	}
+}
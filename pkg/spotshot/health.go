@@ -0,0 +1,88 @@
+package spotshot
+
+import (
+	"html/template"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// creatorStallTimeout is how long PlaylistCreator's loop can go without
+// ticking before it's considered stalled.
+var creatorStallTimeout = 10 * time.Minute
+
+// CreatorStatus tracks PlaylistCreator's loop so its health can be checked.
+type CreatorStatus struct {
+	lastTick int64 // Unix nanoseconds, accessed atomically.
+}
+
+func (s *CreatorStatus) tick() {
+	atomic.StoreInt64(&s.lastTick, timeNow().UnixNano())
+}
+
+// LastTick returns when PlaylistCreator's loop last made progress.
+func (s *CreatorStatus) LastTick() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastTick))
+}
+
+// Stalled reports whether PlaylistCreator's loop hasn't made progress recently.
+func (s *CreatorStatus) Stalled() bool {
+	return atomic.LoadInt64(&s.lastTick) == 0 || timeNow().Sub(s.LastTick()) > creatorStallTimeout
+}
+
+type healthCheck struct {
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	LastTick time.Time `json:"last_tick,omitempty"`
+}
+
+// Healthz responds OK as long as the process is able to serve requests.
+func Healthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// Readyz checks Spotshot's dependencies and responds with the status of each.
+// If any check fails the response has a 503 status.
+func Readyz(redisClient redis.UniversalClient, templates []*template.Template, creatorStatus *CreatorStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := make(map[string]healthCheck)
+		ok := true
+
+		if err := redisClient.Ping().Err(); err != nil {
+			checks["redis"] = healthCheck{Status: "fail", Error: err.Error()}
+			ok = false
+		} else {
+			checks["redis"] = healthCheck{Status: "ok"}
+		}
+
+		checks["templates"] = healthCheck{Status: "ok"}
+		for _, tmpl := range templates {
+			if tmpl == nil || tmpl.Tree == nil {
+				checks["templates"] = healthCheck{Status: "fail", Error: "template not parsed"}
+				ok = false
+				break
+			}
+		}
+
+		creatorCheck := healthCheck{Status: "ok", LastTick: creatorStatus.LastTick()}
+		if creatorStatus.Stalled() {
+			creatorCheck.Status = "fail"
+			creatorCheck.Error = "playlist creator loop has stalled"
+			ok = false
+		}
+		checks["playlist_creator"] = creatorCheck
+
+		status, code := "ok", http.StatusOK
+		if !ok {
+			status, code = "fail", http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, map[string]interface{}{
+			"status": status,
+			"checks": checks,
+		})
+	}
+}
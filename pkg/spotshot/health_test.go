@@ -0,0 +1,62 @@
+package spotshot
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+)
+
+func TestReadyz(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("couldn't start miniredis: %s", err)
+	}
+	defer mr.Close()
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+
+	tmpl := template.Must(template.New("test").Parse("hello"))
+	status := new(CreatorStatus)
+	handler := Readyz(redisClient, []*template.Template{tmpl}, status)
+
+	type response struct {
+		Status string
+		Checks map[string]healthCheck
+	}
+	check := func(wantCode int, wantCreator string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code != wantCode {
+			t.Errorf("expected status %d, got %d", wantCode, w.Code)
+		}
+		var resp response
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatalf("couldn't decode response: %s", err)
+		}
+		if got := resp.Checks["redis"].Status; got != "ok" {
+			t.Errorf("expected redis check to be ok, got %s", got)
+		}
+		if got := resp.Checks["playlist_creator"].Status; got != wantCreator {
+			t.Errorf("expected playlist creator check to be %s, got %s", wantCreator, got)
+		}
+	}
+
+	// The creator hasn't started yet.
+	check(http.StatusServiceUnavailable, "fail")
+
+	status.tick()
+	check(http.StatusOK, "ok")
+
+	// The creator's loop has stalled.
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return time.Now().Add(creatorStallTimeout + time.Minute) }
+	check(http.StatusServiceUnavailable, "fail")
+}
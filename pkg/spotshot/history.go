@@ -0,0 +1,198 @@
+package spotshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/zmb3/spotify"
+)
+
+const (
+	RedisHistoryKey  = "spot_usr_hist"
+	RedisJobsKey     = "spot_usr_jobs"
+	RedisSessionsKey = "spot_usr_sessions"
+
+	// maxJobRecords is how many job records are kept per user.
+	maxJobRecords = 20
+	// maxSnapshotRecords is how many snapshots are kept per user, which is
+	// years of monthly playlists along with plenty of one-off ones.
+	maxSnapshotRecords = 200
+)
+
+// Snapshot is a record of a playlist made for a user.
+type Snapshot struct {
+	// Period is the month the snapshot covers, e.g. "2019-08", or the day
+	// a one-off snapshot was made, e.g. "2019-09-14".
+	Period string `json:"period"`
+	OneOff bool   `json:"one_off"`
+	// Yearly snapshots are a year in review, with the year as their period,
+	// e.g. "2019".
+	Yearly     bool            `json:"yearly,omitempty"`
+	PlaylistID spotify.ID      `json:"playlist_id"`
+	Name       string          `json:"name"`
+	Private    bool            `json:"private"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Tracks     []SnapshotTrack `json:"tracks"`
+}
+
+// SnapshotTrack is a track in a snapshot, in order of rank.
+type SnapshotTrack struct {
+	ID         spotify.ID       `json:"id"`
+	Name       string           `json:"name"`
+	Artists    []SnapshotArtist `json:"artists"`
+	Album      string           `json:"album"`
+	ImageURL   string           `json:"image_url,omitempty"`
+	Popularity int              `json:"popularity"`
+}
+
+// SnapshotArtist is an artist of a snapshot track.
+type SnapshotArtist struct {
+	ID   spotify.ID `json:"id"`
+	Name string     `json:"name"`
+	// Genres are empty for snapshots made before genres were recorded.
+	Genres []string `json:"genres,omitempty"`
+}
+
+// Job is a record of an attempt to make a playlist for a user.
+type Job struct {
+	Type       string    `json:"type"`
+	RequestID  string    `json:"request_id,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Err        string    `json:"error,omitempty"`
+}
+
+// PlaylistURL is the Spotify web link to the snapshot's playlist.
+func (s *Snapshot) PlaylistURL() string {
+	return fmt.Sprintf("https://open.spotify.com/playlist/%s", s.PlaylistID)
+}
+
+// CoverURL is the album art of the snapshot's top track, or empty if it has
+// none.
+func (s *Snapshot) CoverURL() string {
+	for _, track := range s.Tracks {
+		if track.ImageURL != "" {
+			return track.ImageURL
+		}
+	}
+	return ""
+}
+
+// topTracks returns the first n tracks of the snapshot.
+func topTracks(s *Snapshot, n int) []SnapshotTrack {
+	if len(s.Tracks) > n {
+		return s.Tracks[:n]
+	}
+	return s.Tracks
+}
+
+// URL is the Spotify web link to the track.
+func (t *SnapshotTrack) URL() string {
+	return fmt.Sprintf("https://open.spotify.com/track/%s", t.ID)
+}
+
+// ArtistNames lists the track's artists, e.g. "Simon & Garfunkel, Paul Simon".
+func (t *SnapshotTrack) ArtistNames() string {
+	names := make([]string, len(t.Artists))
+	for i, artist := range t.Artists {
+		names[i] = artist.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+func newSnapshotTracks(tracks []spotify.FullTrack) []SnapshotTrack {
+	snapTracks := make([]SnapshotTrack, len(tracks))
+	for i, track := range tracks {
+		snapTracks[i] = SnapshotTrack{
+			ID:         track.ID,
+			Name:       track.Name,
+			Album:      track.Album.Name,
+			Popularity: track.Popularity,
+			Artists:    make([]SnapshotArtist, len(track.Artists)),
+		}
+		if len(track.Album.Images) > 0 {
+			snapTracks[i].ImageURL = track.Album.Images[0].URL
+		}
+		for j, artist := range track.Artists {
+			snapTracks[i].Artists[j] = SnapshotArtist{ID: artist.ID, Name: artist.Name}
+		}
+	}
+	return snapTracks
+}
+
+func saveSnapshot(redisClient redis.UniversalClient, userID string, snapshot *Snapshot) error {
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("couldn't encode snapshot: %w", err)
+	}
+	key := fmt.Sprintf("%s:%s", RedisHistoryKey, userID)
+	// Snapshots are oldest first, so the oldest are trimmed.
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.RPush(key, b)
+		pipe.LTrim(key, -maxSnapshotRecords, -1)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't push to redis key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Snapshots returns all of a user's snapshots, oldest first.
+func Snapshots(redisClient redis.UniversalClient, userID string) ([]Snapshot, error) {
+	key := fmt.Sprintf("%s:%s", RedisHistoryKey, userID)
+	vals, err := redisClient.LRange(key, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	snapshots := make([]Snapshot, len(vals))
+	for i, val := range vals {
+		err = json.Unmarshal([]byte(val), &snapshots[i])
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode snapshot: %w", err)
+		}
+	}
+	return snapshots, nil
+}
+
+func saveJob(redisClient redis.UniversalClient, userID string, job *Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("couldn't encode job: %w", err)
+	}
+	key := fmt.Sprintf("%s:%s", RedisJobsKey, userID)
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.LPush(key, b)
+		pipe.LTrim(key, 0, maxJobRecords-1)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't push to redis key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Jobs returns a user's most recent jobs, newest first.
+func Jobs(redisClient redis.UniversalClient, userID string) ([]Job, error) {
+	key := fmt.Sprintf("%s:%s", RedisJobsKey, userID)
+	vals, err := redisClient.LRange(key, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	return decodeJobs(vals)
+}
+
+// decodeJobs decodes jobs as they're kept in a user's job list.
+func decodeJobs(vals []string) ([]Job, error) {
+	jobs := make([]Job, len(vals))
+	for i, val := range vals {
+		err := json.Unmarshal([]byte(val), &jobs[i])
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode job: %w", err)
+		}
+	}
+	return jobs, nil
+}
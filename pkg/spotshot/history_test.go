@@ -0,0 +1,38 @@
+package spotshot
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+)
+
+func TestSaveSnapshotTrimsHistory(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	user := "coolkid99"
+
+	for i := 0; i < maxSnapshotRecords+5; i++ {
+		err = saveSnapshot(redisClient, user, &Snapshot{Period: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatalf("couldn't save snapshot: %s", err)
+		}
+	}
+	snapshots, err := Snapshots(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't get snapshots: %s", err)
+	}
+	if len(snapshots) != maxSnapshotRecords {
+		t.Fatalf("expected %d snapshots, got %d", maxSnapshotRecords, len(snapshots))
+	}
+	if first, last := snapshots[0].Period, snapshots[len(snapshots)-1].Period; first != "5" || last != fmt.Sprint(maxSnapshotRecords+4) {
+		t.Errorf("expected the oldest snapshots to be trimmed, got %s to %s", first, last)
+	}
+}
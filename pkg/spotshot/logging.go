@@ -0,0 +1,106 @@
+package spotshot
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// validRequestID matches request IDs we're happy to take from clients and
+// put in our logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type logContextKey int
+
+const requestLogContextKey logContextKey = 0
+
+// requestLog is the request-scoped logging state kept in a request's context.
+type requestLog struct {
+	id     string
+	logger logrus.FieldLogger
+	userID string
+}
+
+// RequestLogging is middleware that gives each request an ID, taken from the
+// X-Request-ID header if the client sent a sensible one, and a logger with
+// that ID in the request's context. Once the request is done it writes an
+// access log line.
+func RequestLogging(logger logrus.FieldLogger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			id := r.Header.Get("X-Request-ID")
+			if !validRequestID.MatchString(id) {
+				var err error
+				id, err = randToken(12)
+				if err != nil {
+					logger.Errorf("couldn't generate request ID: %s", err)
+				}
+			}
+			w.Header().Set("X-Request-ID", id)
+			rl := &requestLog{
+				id:     id,
+				logger: logger.WithField("request_id", id),
+			}
+			r = r.WithContext(context.WithValue(r.Context(), requestLogContextKey, rl))
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+			next.ServeHTTP(sw, r)
+
+			fields := logrus.Fields{
+				"method":     r.Method,
+				"route":      routeTemplate(r),
+				"status":     sw.status,
+				"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if rl.userID != "" {
+				fields["user_id"] = rl.userID
+			}
+			rl.logger.WithFields(fields).Info("request")
+		})
+	}
+}
+
+// RequestLogger returns the logger for the request, or the given logger if
+// the request doesn't have one.
+func RequestLogger(r *http.Request, logger logrus.FieldLogger) logrus.FieldLogger {
+	if rl, ok := r.Context().Value(requestLogContextKey).(*requestLog); ok {
+		return rl.logger
+	}
+	return logger
+}
+
+// RequestID returns the request's ID, if it has one.
+func RequestID(r *http.Request) string {
+	if rl, ok := r.Context().Value(requestLogContextKey).(*requestLog); ok {
+		return rl.id
+	}
+	return ""
+}
+
+// setRequestUser records the user making the request, adding their ID to the
+// request's logger and its access log line. It returns the updated logger.
+func setRequestUser(r *http.Request, logger logrus.FieldLogger, userID string) logrus.FieldLogger {
+	rl, ok := r.Context().Value(requestLogContextKey).(*requestLog)
+	if !ok {
+		return logger.WithField("user_id", userID)
+	}
+	rl.userID = userID
+	rl.logger = rl.logger.WithField("user_id", userID)
+	return rl.logger
+}
+
+// statusWriter remembers the status written to the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
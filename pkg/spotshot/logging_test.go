@@ -0,0 +1,62 @@
+package spotshot
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRequestLogging(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	var handlerRequestID string
+	r := mux.NewRouter()
+	r.Path("/users/{id}").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerRequestID = RequestID(r)
+		setRequestUser(r, logger, "coolkid99").Info("handled")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	r.Use(RequestLogging(logger))
+
+	// Sensible request IDs are passed through.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/users/coolkid99", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	r.ServeHTTP(w, req)
+	if w.Header().Get("X-Request-ID") != "abc-123" || handlerRequestID != "abc-123" {
+		t.Errorf("expected request ID abc-123, got %q in response and %q in handler", w.Header().Get("X-Request-ID"), handlerRequestID)
+	}
+	entries := hook.AllEntries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 log entries, got %d", len(entries))
+	}
+	if entries[0].Data["request_id"] != "abc-123" || entries[0].Data["user_id"] != "coolkid99" {
+		t.Errorf("expected handler log to have request and user IDs, got %v", entries[0].Data)
+	}
+	access := entries[1].Data
+	if access["route"] != "/users/{id}" || access["status"] != http.StatusTeapot || access["user_id"] != "coolkid99" || access["method"] != "GET" {
+		t.Errorf("unexpected access log fields %v", access)
+	}
+
+	// Anything else is replaced.
+	hook.Reset()
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/users/coolkid99", nil)
+	req.Header.Set("X-Request-ID", "bad id\nwith newline")
+	r.ServeHTTP(w, req)
+	if id := w.Header().Get("X-Request-ID"); id == "" || id == req.Header.Get("X-Request-ID") {
+		t.Errorf("expected a new request ID, got %q", id)
+	}
+}
+
+func TestRequestLoggerFallback(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	if RequestLogger(httptest.NewRequest("GET", "/", nil), logger) != logger {
+		t.Errorf("expected fallback logger for request without one")
+	}
+}
@@ -0,0 +1,157 @@
+package spotshot
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zmb3/spotify"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spotshot_http_requests_total",
+		Help: "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "spotshot_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	playlistsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spotshot_playlists_total",
+		Help: "Playlist creation attempts by type (monthly, one-off, yearly or changes) and outcome.",
+	}, []string{"type", "outcome"})
+	spotifyRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "spotshot_spotify_request_duration_seconds",
+		Help:    "Spotify API call latency by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+	spotifyErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spotshot_spotify_errors_total",
+		Help: "Failed Spotify API calls by method.",
+	}, []string{"method"})
+)
+
+// Playlist creation outcomes.
+const (
+	outcomeCreated = "created"
+	outcomeSkipped = "skipped"
+	outcomeRevoked = "revoked"
+	outcomeFailed  = "failed"
+)
+
+// RegisterMetrics registers Spotshot's metrics with reg. The subscriber count
+// is read from Redis and the job queue depth from the channel when scraped.
+func RegisterMetrics(reg prometheus.Registerer, redisClient redis.UniversalClient, playlistNowCh chan PlaylistJob) error {
+	collectors := []prometheus.Collector{
+		httpRequestsTotal,
+		httpRequestDuration,
+		playlistsTotal,
+		spotifyRequestDuration,
+		spotifyErrorsTotal,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "spotshot_subscribers",
+			Help: "Number of subscribed users.",
+		}, func() float64 {
+			n, err := countSubscribers(redisClient)
+			if err != nil {
+				return math.NaN()
+			}
+			return float64(n)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "spotshot_job_queue_depth",
+			Help: "Number of one-off playlist jobs waiting to be run.",
+		}, func() float64 {
+			return float64(len(playlistNowCh))
+		}),
+	}
+	for _, c := range collectors {
+		err := reg.Register(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InstrumentHTTP is middleware that counts and times requests by route.
+func InstrumentHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		route := routeTemplate(r)
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(sw.status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeTemplate returns the template of the route the request matched, so
+// that e.g. all user pages are grouped together.
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tmpl, err := current.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return r.URL.Path
+}
+
+// instrumentedSpotifyClient records the latency and errors of Spotify API calls.
+type instrumentedSpotifyClient struct {
+	SpotifyClienter
+}
+
+// instrumentSpotifyClient wraps c so its calls are measured.
+func instrumentSpotifyClient(c SpotifyClienter) SpotifyClienter {
+	return &instrumentedSpotifyClient{c}
+}
+
+func observeSpotifyCall(method string, start time.Time, err error) {
+	spotifyRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		spotifyErrorsTotal.WithLabelValues(method).Inc()
+	}
+}
+
+func (c *instrumentedSpotifyClient) CurrentUsersTopTracksOpt(opts *spotify.Options) (*spotify.FullTrackPage, error) {
+	start := time.Now()
+	page, err := c.SpotifyClienter.CurrentUsersTopTracksOpt(opts)
+	observeSpotifyCall("CurrentUsersTopTracksOpt", start, err)
+	return page, err
+}
+
+func (c *instrumentedSpotifyClient) CreatePlaylistForUser(user, playlistName, desc string, public bool) (*spotify.FullPlaylist, error) {
+	start := time.Now()
+	playlist, err := c.SpotifyClienter.CreatePlaylistForUser(user, playlistName, desc, public)
+	observeSpotifyCall("CreatePlaylistForUser", start, err)
+	return playlist, err
+}
+
+func (c *instrumentedSpotifyClient) AddTracksToPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	start := time.Now()
+	snapshotID, err := c.SpotifyClienter.AddTracksToPlaylist(playlistID, trackIDs...)
+	observeSpotifyCall("AddTracksToPlaylist", start, err)
+	return snapshotID, err
+}
+
+func (c *instrumentedSpotifyClient) SetPlaylistImage(playlistID spotify.ID, img io.Reader) error {
+	start := time.Now()
+	err := c.SpotifyClienter.SetPlaylistImage(playlistID, img)
+	observeSpotifyCall("SetPlaylistImage", start, err)
+	return err
+}
+
+func (c *instrumentedSpotifyClient) GetArtists(ids ...spotify.ID) ([]*spotify.FullArtist, error) {
+	start := time.Now()
+	artists, err := c.SpotifyClienter.GetArtists(ids...)
+	observeSpotifyCall("GetArtists", start, err)
+	return artists, err
+}
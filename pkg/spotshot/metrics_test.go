@@ -0,0 +1,36 @@
+package spotshot
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zmb3/spotify"
+)
+
+func TestInstrumentedSpotifyClient(t *testing.T) {
+	method := "CurrentUsersTopTracksOpt"
+	before := testutil.ToFloat64(spotifyErrorsTotal.WithLabelValues(method))
+
+	limit := 5
+	client := instrumentSpotifyClient(&mockSpotifyClient{})
+	_, err := client.CurrentUsersTopTracksOpt(&spotify.Options{Limit: &limit})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := testutil.ToFloat64(spotifyErrorsTotal.WithLabelValues(method)); got != before {
+		t.Errorf("expected no new errors, got %v", got-before)
+	}
+
+	client = instrumentSpotifyClient(&mockSpotifyClient{err: errors.New("spotify is down")})
+	_, err = client.CurrentUsersTopTracksOpt(&spotify.Options{Limit: &limit})
+	if err == nil {
+		t.Fatalf("expected error to be passed through")
+	}
+	if got := testutil.ToFloat64(spotifyErrorsTotal.WithLabelValues(method)); got != before+1 {
+		t.Errorf("expected 1 new error, got %v", got-before)
+	}
+	if n := testutil.CollectAndCount(spotifyRequestDuration); n == 0 {
+		t.Errorf("expected spotify latency to be observed")
+	}
+}
@@ -0,0 +1,78 @@
+package spotshot
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+)
+
+// Event types.
+const (
+	EventSnapshotCreated     = "snapshot.created"
+	EventSnapshotFailed      = "snapshot.failed"
+	EventChangesCreated      = "changes.created"
+	EventSubscriptionChanged = "subscription.changed"
+)
+
+// Event is something that happened to a user's playlists which they can be
+// notified about.
+type Event struct {
+	Type   string    `json:"type"`
+	UserID string    `json:"user_id"`
+	Time   time.Time `json:"time"`
+	// Snapshot is the new snapshot for snapshot.created events.
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+	// Changes is the new playlist for changes.created events.
+	Changes *ChangesPlaylist `json:"changes,omitempty"`
+	// Err is why the playlist couldn't be made for snapshot.failed events.
+	Err string `json:"error,omitempty"`
+	// Revoked is set for snapshot.failed events if the user removed our
+	// access to their Spotify account.
+	Revoked bool `json:"revoked,omitempty"`
+	// Subscription is the user's new settings for subscription.changed events.
+	Subscription *Subscription `json:"subscription,omitempty"`
+}
+
+// Notifier tells users about events.
+type Notifier interface {
+	Notify(e *Event) error
+}
+
+// notifySubscriptionChanged tells notifier about the user's current subscription.
+func notifySubscriptionChanged(notifier Notifier, redisClient redis.UniversalClient, userID string, logger logrus.FieldLogger) {
+	sub, err := getSubscription(redisClient, userID)
+	if err != nil {
+		logger.Errorf("couldn't send notifications: %s", err)
+		return
+	}
+	err = notifier.Notify(&Event{
+		Type:         EventSubscriptionChanged,
+		UserID:       userID,
+		Time:         timeNow(),
+		Subscription: sub,
+	})
+	if err != nil {
+		logger.Errorf("couldn't send notifications: %s", err)
+	}
+}
+
+// Notifiers sends events to each of its notifiers, carrying on if any fail.
+type Notifiers []Notifier
+
+// Notify sends the event to each notifier.
+func (ns Notifiers) Notify(e *Event) error {
+	var errs []string
+	for _, n := range ns {
+		err := n.Notify(e)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -1,8 +1,13 @@
 package spotshot
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"strings"
 	"time"
 
@@ -14,10 +19,33 @@ import (
 
 const (
 	RedisUserIDKey    = "spot_usr_id"
+	RedisLastRunKey   = "spot_last_run"
+	RedisPausedKey    = "spot_paused"
 	NumSongsField     = "num_songs"
 	RefreshTokenField = "refresh_token"
 	IsPrivateField    = "is_private"
-	DomainName        = "spotshot.jelliott.dev"
+	NeedsReauthField  = "needs_reauth"
+	// ReauthPeriodField is the period of the last monthly run counted towards
+	// NeedsReauthField, so reruns in the same month don't count again.
+	ReauthPeriodField = "reauth_period"
+	LastPeriodField   = "last_period"
+	// LastYearReviewField is the year of the user's last year in review.
+	LastYearReviewField = "last_year_review"
+	DomainName          = "spotshot.jelliott.dev"
+
+	// MaxReauthMonths is how many monthly playlists a user can miss because
+	// their authorization was revoked. They're automatically unsubscribed on
+	// the last one, counting the month it was revoked in.
+	MaxReauthMonths = 3
+
+	// RedisQueuedKey marks users with a job waiting in the queue, so each user
+	// can only have one at a time.
+	RedisQueuedKey = "spot_usr_queued"
+	// queuedJobTTL is how long a user's mark lasts if their job is never run.
+	queuedJobTTL = time.Hour
+	// RedisPendingJobsKey is a list of jobs that were still queued when the
+	// app shut down, to be queued again when it starts.
+	RedisPendingJobsKey = "spot_pending_jobs"
 )
 
 var (
@@ -29,61 +57,296 @@ type SpotifyClienter interface {
 	CurrentUsersTopTracksOpt(opts *spotify.Options) (*spotify.FullTrackPage, error)
 	CreatePlaylistForUser(user, playlistName, desc string, public bool) (*spotify.FullPlaylist, error)
 	AddTracksToPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+	SetPlaylistImage(playlistID spotify.ID, img io.Reader) error
+	GetArtists(ids ...spotify.ID) ([]*spotify.FullArtist, error)
+}
+
+// PlaylistJob asks PlaylistCreator to make a one-off playlist for a user.
+type PlaylistJob struct {
+	UserID spotify.ID
+	// Monthly makes the user's monthly playlist instead, if they don't already
+	// have this month's.
+	Monthly bool
+	// ChangesFrom and ChangesTo are snapshot playlist IDs. If set, a playlist
+	// of the tracks in the user's ChangesTo snapshot that weren't in their
+	// ChangesFrom one is made instead.
+	ChangesFrom, ChangesTo spotify.ID
+	// RequestID is the ID of the request that asked for the playlist, if any.
+	RequestID string
+}
+
+// queuePlaylistJob adds the job to the queue without waiting, as long as the
+// user doesn't already have a job waiting.
+func queuePlaylistJob(redisClient redis.UniversalClient, playlistNowCh chan<- PlaylistJob, job PlaylistJob) error {
+	key := fmt.Sprintf("%s:%s", RedisQueuedKey, job.UserID)
+	ok, err := redisClient.SetNX(key, timeNow().Unix(), queuedJobTTL).Result()
+	if err != nil {
+		return fmt.Errorf("error while setting redis key %s: %w", key, err)
+	}
+	if !ok {
+		return ErrJobQueued
+	}
+	select {
+	case playlistNowCh <- job:
+		return nil
+	default:
+		err = redisClient.Del(key).Err()
+		if err != nil {
+			return fmt.Errorf("couldn't delete redis key %s: %w", key, err)
+		}
+		return ErrQueueFull
+	}
+}
+
+// SavePendingJobs moves the jobs left in the queue to Redis, so they can be
+// restored by RestorePendingJobs once the app starts again. The users' queued
+// marks are cleared with them, since they'd expire before a long outage was
+// over anyway, and are set again when the jobs are restored. It returns how
+// many jobs were saved.
+func SavePendingJobs(redisClient redis.UniversalClient, playlistNowCh <-chan PlaylistJob) (int, error) {
+	n := 0
+	for {
+		select {
+		case job := <-playlistNowCh:
+			b, err := json.Marshal(job)
+			if err != nil {
+				return n, fmt.Errorf("couldn't marshal job: %w", err)
+			}
+			queuedKey := fmt.Sprintf("%s:%s", RedisQueuedKey, job.UserID)
+			_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.RPush(RedisPendingJobsKey, b)
+				pipe.Del(queuedKey)
+				return nil
+			})
+			if err != nil {
+				return n, fmt.Errorf("error while setting redis key %s: %w", RedisPendingJobsKey, err)
+			}
+			n++
+		default:
+			return n, nil
+		}
+	}
+}
+
+// RestorePendingJobs queues the jobs saved by SavePendingJobs, as many as
+// there is room for. Any left over stay saved for the next start. Jobs for
+// users that have queued another since, e.g. with another instance of the
+// app, are dropped. It returns how many jobs were restored.
+func RestorePendingJobs(redisClient redis.UniversalClient, playlistNowCh chan<- PlaylistJob, logger logrus.FieldLogger) (int, error) {
+	n := 0
+	for len(playlistNowCh) < cap(playlistNowCh) {
+		b, err := redisClient.LPop(RedisPendingJobsKey).Bytes()
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			return n, fmt.Errorf("couldn't get redis key %s: %w", RedisPendingJobsKey, err)
+		}
+		var job PlaylistJob
+		err = json.Unmarshal(b, &job)
+		if err != nil {
+			logger.Errorf("dropping queued playlist job %q: couldn't unmarshal job: %s", b, err)
+			continue
+		}
+		queuedKey := fmt.Sprintf("%s:%s", RedisQueuedKey, job.UserID)
+		ok, err := redisClient.SetNX(queuedKey, timeNow().Unix(), queuedJobTTL).Result()
+		if err != nil {
+			return n, fmt.Errorf("error while setting redis key %s: %w", queuedKey, err)
+		}
+		if !ok {
+			logger.WithField("user_id", job.UserID).Info("dropping queued playlist job since the user has queued another")
+			continue
+		}
+		playlistNowCh <- job
+		n++
+	}
+	return n, nil
 }
 
-func SpotifyClientCreator(auth spotify.Authenticator) func(*oauth2.Token) SpotifyClienter {
-	return func(token *oauth2.Token) SpotifyClienter {
-		client := auth.NewClient(token)
-		return &client
+func SpotifyClientCreator(auth Authenticator) func(*oauth2.Token) (SpotifyClienter, error) {
+	return func(token *oauth2.Token) (SpotifyClienter, error) {
+		return auth.NewClient(token)
 	}
 }
 
 // PlaylistCreator will check every hour for Spotify users to create playlists for.
-// Will only return if the given context is done.
-func PlaylistCreator(ctx context.Context, redisClient redis.UniversalClient, logger logrus.FieldLogger, GetSpotifyClient func(token *oauth2.Token) SpotifyClienter, playlistNowCh <-chan spotify.ID) {
-	curMonth := timeNow().Month()
+// It ticks status whenever it makes progress, and tells notifier how each
+// playlist went.
+// Will only return if the given context is done, which it checks between
+// playlists so that none are left half made.
+func PlaylistCreator(ctx context.Context, redisClient redis.UniversalClient, logger logrus.FieldLogger, GetSpotifyClient func(token *oauth2.Token) (SpotifyClienter, error), playlistNowCh <-chan PlaylistJob, status *CreatorStatus, notifier Notifier) {
+	// The month of the last finished monthly run is kept in Redis, so a run
+	// that was interrupted by a restart is picked up again.
+	err := redisClient.SetNX(RedisLastRunKey, timeNow().Format("2006-01"), 0).Err()
+	if err != nil {
+		logger.Errorf("error while setting redis key %s: %s", RedisLastRunKey, err)
+	}
 	for {
+		status.tick()
 		// Periodically check if it's a new month.
 		select {
 		case <-time.After(monthCheckFreq):
-			if timeNow().Month() == curMonth {
+			due, err := monthlyRunDue(redisClient)
+			if err != nil {
+				logger.Error(err)
+				continue
+			}
+			if !due {
 				continue
 			}
 			// New month!
-			curMonth = timeNow().Month()
-		case userID := <-playlistNowCh:
+		case job := <-playlistNowCh:
 			// Make a one-off playlist for the user.
-			key := fmt.Sprintf("%s:%s", RedisUserIDKey, userID)
-			logger = logger.WithField("user_id", userID)
-			err := createPlaylist(key, true, redisClient, logger, GetSpotifyClient)
+			key := fmt.Sprintf("%s:%s", RedisUserIDKey, job.UserID)
+			jobLogger := logger.WithField("user_id", job.UserID)
+			if job.RequestID != "" {
+				jobLogger = jobLogger.WithField("request_id", job.RequestID)
+			}
+			// The user can queue another job now this one has started.
+			queuedKey := fmt.Sprintf("%s:%s", RedisQueuedKey, job.UserID)
+			err := redisClient.Del(queuedKey).Err()
 			if err != nil {
-				logger.Error(err)
+				jobLogger.Errorf("couldn't delete redis key %s: %s", queuedKey, err)
+			}
+			if job.ChangesTo != "" {
+				runChangesJob(key, job, redisClient, jobLogger, GetSpotifyClient, notifier)
+				continue
 			}
+			runPlaylistJob(key, !job.Monthly, job.RequestID, redisClient, jobLogger, GetSpotifyClient, notifier)
 			continue
 		case <-ctx.Done():
 			return
 		}
 
+		month := timeNow().Format("2006-01")
 		logger.Infof("creating playlists")
 
-		keys, err := redisClient.Keys(fmt.Sprintf("%s:*", RedisUserIDKey)).Result()
+		keys, err := scanKeys(redisClient, fmt.Sprintf("%s:*", RedisUserIDKey))
 		if err != nil {
-			logger.Errorf("couldn't get redis keys: %s", err)
+			logger.Error(err)
 			continue
 		}
-		for _, key := range keys {
-			userID := spotify.ID(strings.Split(key, ":")[1])
-			logger = logger.WithField("user_id", userID)
-			err = createPlaylist(key, false, redisClient, logger, GetSpotifyClient)
-			if err != nil {
-				logger.Error(err)
-				continue
+		finished := true
+		for i, key := range keys {
+			if ctx.Err() != nil {
+				logger.Infof("stopping monthly run with %d users left", len(keys)-i)
+				return
 			}
+			if paused, err := redisClient.Exists(RedisPausedKey).Result(); err == nil && paused > 0 {
+				logger.Infof("pausing monthly run with %d users left", len(keys)-i)
+				finished = false
+				break
+			}
+			status.tick()
+			userID := spotify.ID(strings.Split(key, ":")[1])
+			runPlaylistJob(key, false, "", redisClient, logger.WithField("user_id", userID), GetSpotifyClient, notifier)
+		}
+		if !finished {
+			continue
 		}
+		err = redisClient.Set(RedisLastRunKey, month, 0).Err()
+		if err != nil {
+			logger.Errorf("error while setting redis key %s: %s", RedisLastRunKey, err)
+		}
+	}
+}
+
+// monthlyRunDue reports whether the monthly run should start, which is when
+// it hasn't finished this month and the scheduler isn't paused.
+func monthlyRunDue(redisClient redis.UniversalClient) (bool, error) {
+	var lastRun *redis.StringCmd
+	var paused *redis.IntCmd
+	_, err := redisClient.Pipelined(func(pipe redis.Pipeliner) error {
+		lastRun = pipe.Get(RedisLastRunKey)
+		paused = pipe.Exists(RedisPausedKey)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return false, fmt.Errorf("couldn't get scheduler state: %w", err)
 	}
+	return paused.Val() == 0 && lastRun.Val() != timeNow().Format("2006-01"), nil
+}
+
+// monthlyPeriod is the period covered by a monthly playlist made at the
+// given time, which is the previous month.
+func monthlyPeriod(now time.Time) string {
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, -1, 0).Format("2006-01")
 }
 
-func createPlaylist(key string, isOneOff bool, redisClient redis.UniversalClient, logger logrus.FieldLogger, GetSpotifyClient func(token *oauth2.Token) SpotifyClienter) error {
+// runPlaylistJob makes a playlist for the user, keeps a record of how it went
+// and lets them know.
+func runPlaylistJob(key string, isOneOff bool, requestID string, redisClient redis.UniversalClient, logger logrus.FieldLogger, GetSpotifyClient func(token *oauth2.Token) (SpotifyClienter, error), notifier Notifier) {
+	job := &Job{Type: "monthly", RequestID: requestID, StartedAt: timeNow()}
+	if isOneOff {
+		job.Type = "one-off"
+	}
+	snapshot, err := createPlaylist(key, isOneOff, redisClient, logger, GetSpotifyClient, notifier)
+	finishJob(key, job, snapshotCreated(snapshot), err, redisClient, logger, notifier)
+
+	// January's run also makes the year in review, after December's playlist
+	// so it's included. The review doesn't depend on it though, so it's still
+	// made if December's fails. Reruns skip it once it's made.
+	if !isOneOff && timeNow().Month() == time.January {
+		job = &Job{Type: "yearly", RequestID: requestID, StartedAt: timeNow()}
+		snapshot, err = createYearReview(key, redisClient, logger, GetSpotifyClient)
+		finishJob(key, job, snapshotCreated(snapshot), err, redisClient, logger, notifier)
+	}
+}
+
+// snapshotCreated is the event for a new snapshot, or nil if none was made.
+func snapshotCreated(snapshot *Snapshot) *Event {
+	if snapshot == nil {
+		return nil
+	}
+	return &Event{Type: EventSnapshotCreated, Snapshot: snapshot}
+}
+
+// finishJob records how the job went and tells notifier about it. created is
+// the event to send if the job made a playlist, or nil if it was skipped.
+func finishJob(key string, job *Job, created *Event, err error, redisClient redis.UniversalClient, logger logrus.FieldLogger, notifier Notifier) {
+	outcome := outcomeCreated
+	switch {
+	case err != nil && isAuthRevoked(err):
+		outcome = outcomeRevoked
+	case err != nil:
+		outcome = outcomeFailed
+	case created == nil:
+		outcome = outcomeSkipped
+	}
+	playlistsTotal.WithLabelValues(job.Type, outcome).Inc()
+	if err != nil {
+		handleCreatePlaylistErr(key, err, redisClient, logger)
+		job.Err = err.Error()
+	}
+	job.FinishedAt = timeNow()
+	userID := strings.Split(key, ":")[1]
+	err = saveJob(redisClient, userID, job)
+	if err != nil {
+		logger.Error(err)
+	}
+
+	event := &Event{UserID: userID, Time: job.FinishedAt}
+	switch outcome {
+	case outcomeCreated:
+		event = created
+		event.UserID, event.Time = userID, job.FinishedAt
+	case outcomeFailed, outcomeRevoked:
+		event.Type = EventSnapshotFailed
+		event.Err = job.Err
+		event.Revoked = outcome == outcomeRevoked
+	default:
+		return
+	}
+	err = notifier.Notify(event)
+	if err != nil {
+		logger.Errorf("couldn't send notifications: %s", err)
+	}
+}
+
+// createPlaylist makes a playlist of the user's top tracks and records it in
+// their history. If they aren't due a playlist, no snapshot is returned.
+// notifier is told if they're unsubscribed for not reauthorizing.
+func createPlaylist(key string, isOneOff bool, redisClient redis.UniversalClient, logger logrus.FieldLogger, GetSpotifyClient func(token *oauth2.Token) (SpotifyClienter, error), notifier Notifier) (*Snapshot, error) {
 	creationType := "monthly"
 	if isOneOff {
 		creationType = "one-off"
@@ -93,17 +356,74 @@ func createPlaylist(key string, isOneOff bool, redisClient redis.UniversalClient
 	// If NumSongsField doesn't exist then they aren't subscribed.
 	exists, err := redisClient.HExists(key, NumSongsField).Result()
 	if err != nil {
-		return fmt.Errorf("couldn't get num songs: %w", err)
+		return nil, fmt.Errorf("couldn't get num songs: %w", err)
 	}
 	if !exists {
 		logger.Info("ignore playlist creation since not subscribed")
-		return nil
+		return nil, nil
+	}
+
+	// Skip users that have revoked our access. Each missed month counts
+	// towards automatically unsubscribing them, once however many times the
+	// monthly run is started.
+	reauthMonths, err := redisClient.HGet(key, NeedsReauthField).Int()
+	if err != redis.Nil {
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get needs reauth field: %w", err)
+		}
+		if isOneOff {
+			logger.Info("ignore playlist creation since authorization needs renewing")
+			return nil, nil
+		}
+		period := monthlyPeriod(timeNow())
+		reauthPeriod, err := redisClient.HGet(key, ReauthPeriodField).Result()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("couldn't get reauth period: %w", err)
+		}
+		if reauthPeriod == period {
+			logger.Info("ignore playlist creation since authorization needs renewing")
+			return nil, nil
+		}
+		reauthMonths++
+		if reauthMonths >= MaxReauthMonths {
+			userID := strings.Split(key, ":")[1]
+			err = unsubscribe(redisClient, userID)
+			if err != nil {
+				return nil, err
+			}
+			logger.Infof("unsubscribed after %d months without authorization", reauthMonths)
+			notifySubscriptionChanged(notifier, redisClient, userID, logger)
+			return nil, nil
+		}
+		_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(key, NeedsReauthField, reauthMonths)
+			pipe.HSet(key, ReauthPeriodField, period)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error while setting redis key %s: %w", NeedsReauthField, err)
+		}
+		logger.Info("ignore playlist creation since authorization needs renewing")
+		return nil, nil
+	}
+
+	// Skip users that already have this month's playlist, e.g. if the last
+	// monthly run was interrupted.
+	if !isOneOff {
+		lastPeriod, err := redisClient.HGet(key, LastPeriodField).Result()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("couldn't get last period: %w", err)
+		}
+		if lastPeriod == monthlyPeriod(timeNow()) {
+			logger.Info("ignore playlist creation since already made this month")
+			return nil, nil
+		}
 	}
 
 	// Get privacy setting for new playlists.
 	isPrivate, err := redisClient.HExists(key, IsPrivateField).Result()
 	if err != nil {
-		return fmt.Errorf("couldn't get privacy field: %w", err)
+		return nil, fmt.Errorf("couldn't get privacy field: %w", err)
 	}
 
 	// Fetch the refresh token and make a new Spotify client.
@@ -111,14 +431,18 @@ func createPlaylist(key string, isOneOff bool, redisClient redis.UniversalClient
 	token := new(oauth2.Token)
 	token.RefreshToken, err = redisClient.HGet(key, RefreshTokenField).Result()
 	if err != nil {
-		return fmt.Errorf("couldn't get refresh token: %w", err)
+		return nil, fmt.Errorf("couldn't get refresh token: %w", err)
+	}
+	client, err := GetSpotifyClient(token)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't refresh token: %w", err)
 	}
-	spotClient := GetSpotifyClient(token)
+	spotClient := instrumentSpotifyClient(client)
 
 	// Get numsongs-many top tracks for past month.
 	numSongs, err := redisClient.HGet(key, NumSongsField).Int()
 	if err != nil {
-		return fmt.Errorf("couldn't get num songs: %w", err)
+		return nil, fmt.Errorf("couldn't get num songs: %w", err)
 	}
 	timerange := "short" // Approx. 4 weeks.
 	opts := &spotify.Options{
@@ -127,7 +451,7 @@ func createPlaylist(key string, isOneOff bool, redisClient redis.UniversalClient
 	}
 	fullTrackPage, err := spotClient.CurrentUsersTopTracksOpt(opts)
 	if err != nil {
-		return fmt.Errorf("err fetching curr user top tracks: %w", err)
+		return nil, fmt.Errorf("err fetching curr user top tracks: %w", err)
 	}
 
 	// Playlist name will look like "Aug 19".
@@ -157,7 +481,7 @@ func createPlaylist(key string, isOneOff bool, redisClient redis.UniversalClient
 	userID := strings.Split(key, ":")[1]
 	fullPlaylist, err := spotClient.CreatePlaylistForUser(userID, playlistName, playlistDesc, !isPrivate)
 	if err != nil {
-		return fmt.Errorf("err creating playlist for user: %w", err)
+		return nil, fmt.Errorf("err creating playlist for user: %w", err)
 	}
 	// Add all the user's top tracks to the new playlist.
 	trackIDs := make([]spotify.ID, len(fullTrackPage.Tracks))
@@ -166,9 +490,87 @@ func createPlaylist(key string, isOneOff bool, redisClient redis.UniversalClient
 	}
 	_, err = spotClient.AddTracksToPlaylist(fullPlaylist.ID, trackIDs...)
 	if err != nil {
-		return fmt.Errorf("err adding tracks to playlist: %w", err)
+		return nil, fmt.Errorf("err adding tracks to playlist: %w", err)
+	}
+
+	period := monthlyPeriod(now)
+	if isOneOff {
+		period = now.Format("2006-01-02")
+	}
+	// Give the playlist its own cover. Users who logged in before we asked
+	// to upload images can't have one, but still get their playlist.
+	cover, err := renderCover(userID, period)
+	if err == nil {
+		err = spotClient.SetPlaylistImage(fullPlaylist.ID, bytes.NewReader(cover))
+	}
+	if err != nil {
+		logger.Warnf("couldn't set playlist cover: %s", err)
+	}
+
+	// Genres are only used for stats, so the snapshot is still kept without
+	// them.
+	snapTracks := newSnapshotTracks(fullTrackPage.Tracks)
+	err = addArtistGenres(spotClient, snapTracks)
+	if err != nil {
+		logger.Warnf("couldn't get artist genres: %s", err)
+	}
+
+	// Keep a record of the snapshot.
+	snapshot := &Snapshot{
+		Period:     period,
+		OneOff:     isOneOff,
+		PlaylistID: fullPlaylist.ID,
+		Name:       playlistName,
+		Private:    isPrivate,
+		CreatedAt:  now,
+		Tracks:     snapTracks,
+	}
+	err = saveSnapshot(redisClient, userID, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if !isOneOff {
+		err = redisClient.HSet(key, LastPeriodField, period).Err()
+		if err != nil {
+			return nil, fmt.Errorf("error while setting redis key %s: %w", LastPeriodField, err)
+		}
 	}
 
 	logger.Infof("created %s playlist", creationType)
-	return nil
+	return snapshot, nil
+}
+
+// handleCreatePlaylistErr logs a failed playlist creation. If the failure was
+// because the user revoked our access, their subscription is marked as needing
+// reauthorization so they are skipped until they log in again.
+func handleCreatePlaylistErr(key string, err error, redisClient redis.UniversalClient, logger logrus.FieldLogger) {
+	if !isAuthRevoked(err) {
+		logger.Error(err)
+		return
+	}
+	logger.Warnf("authorization revoked: %s", err)
+	// The month it failed in is the first one they miss.
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(key, NeedsReauthField, 1)
+		pipe.HSetNX(key, ReauthPeriodField, monthlyPeriod(timeNow()))
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("error while setting redis key %s: %s", NeedsReauthField, err)
+	}
+}
+
+// isAuthRevoked reports whether err was caused by the user's refresh token no
+// longer being accepted, i.e. they removed Spotshot from their Spotify account.
+func isAuthRevoked(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return bytes.Contains(retrieveErr.Body, []byte("invalid_grant")) ||
+			(retrieveErr.Response != nil && retrieveErr.Response.StatusCode == http.StatusUnauthorized)
+	}
+	var spotErr spotify.Error
+	if errors.As(err, &spotErr) {
+		return spotErr.Status == http.StatusUnauthorized
+	}
+	return false
 }
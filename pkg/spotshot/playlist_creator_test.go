@@ -1,8 +1,12 @@
 package spotshot
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"image/jpeg"
+	"io"
 	"io/ioutil"
 	"regexp"
 	"strconv"
@@ -18,6 +22,7 @@ import (
 
 type mockSpotifyClient struct {
 	playlists []playlist
+	err       error
 }
 
 type playlist struct {
@@ -26,20 +31,25 @@ type playlist struct {
 	desc   string
 	public bool
 	tracks []spotify.ID
+	image  []byte
 }
 
 func (m *mockSpotifyClient) CurrentUsersTopTracksOpt(opts *spotify.Options) (*spotify.FullTrackPage, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
 	tracks := make([]spotify.FullTrack, *opts.Limit)
 	for i := 0; i < *opts.Limit; i++ {
-		tracks[i].ID = spotify.ID(i)
+		tracks[i].ID = spotify.ID(strconv.Itoa(i))
+		tracks[i].Artists = []spotify.SimpleArtist{{ID: spotify.ID("artist" + strconv.Itoa(i%2)), Name: "Artist"}}
 	}
 	return &spotify.FullTrackPage{Tracks: tracks}, nil
 }
 
 func (m *mockSpotifyClient) CreatePlaylistForUser(user, name, desc string, public bool) (*spotify.FullPlaylist, error) {
-	m.playlists = append(m.playlists, playlist{user, name, desc, public, make([]spotify.ID, 0)})
+	m.playlists = append(m.playlists, playlist{user, name, desc, public, make([]spotify.ID, 0), nil})
 	fp := &spotify.FullPlaylist{}
-	fp.ID = spotify.ID(0)
+	fp.ID = spotify.ID("0")
 	return fp, nil
 }
 
@@ -50,6 +60,25 @@ func (m *mockSpotifyClient) AddTracksToPlaylist(playlistID spotify.ID, trackIDs
 	return "", nil
 }
 
+func (m *mockSpotifyClient) SetPlaylistImage(playlistID spotify.ID, img io.Reader) error {
+	b, err := ioutil.ReadAll(img)
+	if err != nil {
+		return err
+	}
+	m.playlists[len(m.playlists)-1].image = b
+	return nil
+}
+
+// gives each artist a genre named after them
+func (m *mockSpotifyClient) GetArtists(ids ...spotify.ID) ([]*spotify.FullArtist, error) {
+	artists := make([]*spotify.FullArtist, len(ids))
+	for i, id := range ids {
+		artists[i] = &spotify.FullArtist{Genres: []string{"genre " + string(id)}}
+		artists[i].ID = id
+	}
+	return artists, nil
+}
+
 func (m *mockSpotifyClient) clear() {
 	m.playlists = make([]playlist, 0)
 }
@@ -58,10 +87,10 @@ type motherOfSpotClients struct {
 	msc *mockSpotifyClient
 }
 
-func (m *motherOfSpotClients) mockSpotifyClientCreator(spotify.Authenticator) func(*oauth2.Token) SpotifyClienter {
-	return func(token *oauth2.Token) SpotifyClienter {
+func (m *motherOfSpotClients) mockSpotifyClientCreator(Authenticator) func(*oauth2.Token) (SpotifyClienter, error) {
+	return func(token *oauth2.Token) (SpotifyClienter, error) {
 		m.msc = &mockSpotifyClient{}
-		return m.msc
+		return m.msc, nil
 	}
 }
 
@@ -91,12 +120,9 @@ func TestPlaylistCreatorSubscribedUser(t *testing.T) {
 	logger.Out = ioutil.Discard
 
 	// Set timeNow to return a time that is initially offset to 25ms before new month.
+	// It's not January, which would also make the year in review.
 	now := time.Now()
-	nextMonth := now.Month() + 1
-	if nextMonth == 13 {
-		nextMonth = 1
-	}
-	nextMonthTime := time.Date(now.Year(), nextMonth, 1, 0, 0, 0, 0, now.Location())
+	nextMonthTime := time.Date(2019, time.September, 1, 0, 0, 0, 0, now.Location())
 	offset := nextMonthTime.Sub(now) - 25*time.Millisecond
 	timeNow = func() time.Time {
 		return time.Now().Add(offset)
@@ -106,8 +132,8 @@ func TestPlaylistCreatorSubscribedUser(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
 	mother := new(motherOfSpotClients)
-	playlistNowCh := make(chan spotify.ID)
-	PlaylistCreator(ctx, redisClient, logger, mother.mockSpotifyClientCreator(spotify.Authenticator{}), playlistNowCh)
+	playlistNowCh := make(chan PlaylistJob)
+	PlaylistCreator(ctx, redisClient, logger, mother.mockSpotifyClientCreator(Authenticator{}), playlistNowCh, new(CreatorStatus), Notifiers(nil))
 	close(playlistNowCh)
 
 	if mother.msc == nil {
@@ -125,6 +151,9 @@ func TestPlaylistCreatorSubscribedUser(t *testing.T) {
 	if len(mother.msc.playlists[0].tracks) != numSongs {
 		t.Errorf("expected %d songs, got %d", numSongs, len(mother.msc.playlists[0].tracks))
 	}
+	if _, err := jpeg.Decode(bytes.NewReader(mother.msc.playlists[0].image)); err != nil {
+		t.Errorf("expected playlist to get a JPEG cover: %s", err)
+	}
 	match, err := regexp.MatchString(`Your Top Songs (Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec) \d{2}`, mother.msc.playlists[0].name)
 	if err != nil {
 		t.Fatalf("couldn't compile regex: %s", err)
@@ -140,3 +169,265 @@ func TestPlaylistCreatorSubscribedUser(t *testing.T) {
 		t.Errorf("playlist desc does not match expected format, got %s", mother.msc.playlists[0].desc)
 	}
 }
+
+func TestPlaylistCreatorResumesMonthlyRun(t *testing.T) {
+	// An interrupted monthly run should carry on after a restart, skipping
+	// users that already got their playlist.
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	// It's not January, which would also make the year in review.
+	now := time.Date(2019, time.September, 15, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+	s.Set(RedisLastRunKey, now.AddDate(0, 0, -now.Day()).Format("2006-01"))
+	doneKey := fmt.Sprintf("%s:%s", RedisUserIDKey, "done")
+	s.HSet(doneKey, NumSongsField, "10")
+	s.HSet(doneKey, RefreshTokenField, "test")
+	s.HSet(doneKey, LastPeriodField, monthlyPeriod(now))
+	leftKey := fmt.Sprintf("%s:%s", RedisUserIDKey, "left")
+	s.HSet(leftKey, NumSongsField, "10")
+	s.HSet(leftKey, RefreshTokenField, "test")
+
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	monthCheckFreq = 5 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	msc := &mockSpotifyClient{}
+	PlaylistCreator(ctx, redisClient, logger, func(*oauth2.Token) (SpotifyClienter, error) { return msc, nil }, make(chan PlaylistJob), new(CreatorStatus), Notifiers(nil))
+
+	if len(msc.playlists) != 1 {
+		t.Fatalf("expected 1 playlist, got %d", len(msc.playlists))
+	}
+	if msc.playlists[0].user != "left" {
+		t.Errorf("expected user left, got %s", msc.playlists[0].user)
+	}
+	if got, _ := s.Get(RedisLastRunKey); got != now.Format("2006-01") {
+		t.Errorf("expected last run %s, got %s", now.Format("2006-01"), got)
+	}
+	if got := s.HGet(leftKey, LastPeriodField); got != monthlyPeriod(now) {
+		t.Errorf("expected last period %s, got %s", monthlyPeriod(now), got)
+	}
+}
+
+func TestCreatePlaylistRevokedUser(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	user := "coolkid99"
+	key := fmt.Sprintf("%s:%s", RedisUserIDKey, user)
+	s.HSet(key, NumSongsField, "30")
+	s.HSet(key, RefreshTokenField, "test")
+
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	var events []*Event
+	notifier := notifierFunc(func(e *Event) error {
+		events = append(events, e)
+		return nil
+	})
+
+	msc := &mockSpotifyClient{err: spotify.Error{Message: "The access token expired", Status: 401}}
+	getClient := func(*oauth2.Token) (SpotifyClienter, error) { return msc, nil }
+	now := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	// The first failure should mark the user as needing reauth.
+	_, err = createPlaylist(key, false, redisClient, logger, getClient, notifier)
+	if !isAuthRevoked(err) {
+		t.Fatalf("expected revoked authorization error, got %v", err)
+	}
+	handleCreatePlaylistErr(key, err, redisClient, logger)
+	if s.HGet(key, NeedsReauthField) != "1" {
+		t.Fatalf("expected %s to be 1, got %q", NeedsReauthField, s.HGet(key, NeedsReauthField))
+	}
+
+	// Running the monthly job again in the same month, e.g. after a restart
+	// or from the admin page, shouldn't count as a missed month.
+	_, err = createPlaylist(key, false, redisClient, logger, getClient, notifier)
+	if err != nil {
+		t.Fatalf("expected user to be skipped, got %s", err)
+	}
+	if s.HGet(key, NeedsReauthField) != "1" {
+		t.Errorf("expected %s to stay 1 in the same month, got %q", NeedsReauthField, s.HGet(key, NeedsReauthField))
+	}
+
+	// Following monthly runs should skip the user until they're unsubscribed,
+	// counting each month once however many times the job runs. The month it
+	// failed in was the first missed.
+	for i := 2; i <= MaxReauthMonths; i++ {
+		now = now.AddDate(0, 1, 0)
+		for run := 0; run < 2; run++ {
+			_, err = createPlaylist(key, false, redisClient, logger, getClient, notifier)
+			if err != nil {
+				t.Fatalf("expected user to be skipped, got %s", err)
+			}
+		}
+		if i < MaxReauthMonths && s.HGet(key, NeedsReauthField) != strconv.Itoa(i) {
+			t.Errorf("expected %s to be %d, got %q", NeedsReauthField, i, s.HGet(key, NeedsReauthField))
+		}
+		if i < MaxReauthMonths && s.HGet(key, NumSongsField) == "" {
+			t.Errorf("expected user to still be subscribed after %d months", i)
+		}
+	}
+	if s.HGet(key, NumSongsField) != "" {
+		t.Errorf("expected user to be unsubscribed after %d months", MaxReauthMonths)
+	}
+	if len(events) != 1 || events[0].Type != EventSubscriptionChanged || events[0].Subscription.Subscribed {
+		t.Errorf("expected one %s event for unsubscribing, got %v", EventSubscriptionChanged, events)
+	}
+	if len(msc.playlists) != 0 {
+		t.Errorf("expected no playlists, got %d", len(msc.playlists))
+	}
+}
+
+func TestRunPlaylistJobRecordsSnapshot(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	user := "coolkid99"
+	key := fmt.Sprintf("%s:%s", RedisUserIDKey, user)
+	s.HSet(key, NumSongsField, "10")
+	s.HSet(key, RefreshTokenField, "test")
+
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	msc := &mockSpotifyClient{}
+	runPlaylistJob(key, true, "", redisClient, logger, func(*oauth2.Token) (SpotifyClienter, error) { return msc, nil }, Notifiers(nil))
+
+	snapshots, err := Snapshots(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't get snapshots: %s", err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("expected 1 snapshot, got %d", len(snapshots))
+	}
+	if !snapshots[0].OneOff {
+		t.Errorf("expected one-off snapshot")
+	}
+	if len(snapshots[0].Tracks) != 10 {
+		t.Errorf("expected 10 tracks, got %d", len(snapshots[0].Tracks))
+	} else if genres := snapshots[0].Tracks[1].Artists[0].Genres; len(genres) != 1 || genres[0] != "genre artist1" {
+		t.Errorf("expected the artist's genres to be saved, got %v", genres)
+	}
+	jobs, err := Jobs(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't get jobs: %s", err)
+	}
+	if len(jobs) != 1 || jobs[0].Err != "" {
+		t.Errorf("expected 1 successful job, got %+v", jobs)
+	}
+}
+
+func TestQueuePlaylistJob(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	playlistNowCh := make(chan PlaylistJob, 1)
+
+	err = queuePlaylistJob(redisClient, playlistNowCh, PlaylistJob{UserID: "coolkid99"})
+	if err != nil {
+		t.Fatalf("couldn't queue job: %s", err)
+	}
+	// Only one job can be waiting for each user.
+	err = queuePlaylistJob(redisClient, playlistNowCh, PlaylistJob{UserID: "coolkid99"})
+	if !errors.Is(err, ErrJobQueued) {
+		t.Errorf("expected ErrJobQueued, got %v", err)
+	}
+	// The queue is full, so other users are turned away without waiting.
+	err = queuePlaylistJob(redisClient, playlistNowCh, PlaylistJob{UserID: "someoneelse"})
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+	if s.Exists(RedisQueuedKey + ":someoneelse") {
+		t.Errorf("expected a user whose job wasn't queued to be able to try again")
+	}
+}
+
+func TestSaveAndRestorePendingJobs(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	jobs := []PlaylistJob{
+		{UserID: "coolkid99", RequestID: "abc"},
+		{UserID: "lamekid42", Monthly: true},
+		{UserID: "someoneelse"},
+	}
+	playlistNowCh := make(chan PlaylistJob, len(jobs))
+	for _, job := range jobs {
+		err = queuePlaylistJob(redisClient, playlistNowCh, job)
+		if err != nil {
+			t.Fatalf("couldn't queue job: %s", err)
+		}
+	}
+
+	n, err := SavePendingJobs(redisClient, playlistNowCh)
+	if err != nil {
+		t.Fatalf("couldn't save jobs: %s", err)
+	}
+	if n != 3 || len(playlistNowCh) != 0 {
+		t.Fatalf("expected 3 jobs to be moved out of the queue, got %d with %d left", n, len(playlistNowCh))
+	}
+	if s.Exists(RedisQueuedKey + ":coolkid99") {
+		t.Errorf("expected queued marks to be cleared with the saved jobs")
+	}
+	// Broken jobs are skipped, and users that queued a job while the app was
+	// down keep theirs.
+	s.Lpush(RedisPendingJobsKey, "not json")
+	s.Set(RedisQueuedKey+":someoneelse", "1")
+
+	// Only as many jobs as fit are restored. The rest wait for next time.
+	smallCh := make(chan PlaylistJob, 1)
+	n, err = RestorePendingJobs(redisClient, smallCh, logger)
+	if err != nil {
+		t.Fatalf("couldn't restore jobs: %s", err)
+	}
+	if n != 1 || <-smallCh != jobs[0] {
+		t.Errorf("expected the first job to be restored, got %d jobs", n)
+	}
+	if !s.Exists(RedisQueuedKey + ":coolkid99") {
+		t.Errorf("expected the restored job's user to be marked as queued")
+	}
+	n, err = RestorePendingJobs(redisClient, playlistNowCh, logger)
+	if err != nil {
+		t.Fatalf("couldn't restore jobs: %s", err)
+	}
+	if n != 1 || <-playlistNowCh != jobs[1] {
+		t.Errorf("expected only the second job to be restored, got %d jobs", n)
+	}
+	if s.Exists(RedisPendingJobsKey) {
+		t.Errorf("expected no jobs to be left saved")
+	}
+}
@@ -0,0 +1,258 @@
+package spotshot
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// RedisPublicKey holds the user's public page settings.
+	RedisPublicKey = "spot_usr_public"
+	// RedisHandleKey maps public page handles to user IDs.
+	RedisHandleKey = "spot_handle"
+
+	publicHandleField       = "handle"
+	publicSharePrivateField = "share_private"
+)
+
+var handleRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,29}$`)
+
+// PublicSettings are the user's settings for their public pages.
+type PublicSettings struct {
+	Handle string `json:"handle"`
+	// SharePrivate is whether snapshots of private playlists are public too.
+	SharePrivate bool `json:"share_private"`
+}
+
+// getPublicSettings returns nil if the user hasn't turned on public pages.
+func getPublicSettings(redisClient redis.UniversalClient, userID string) (*PublicSettings, error) {
+	key := fmt.Sprintf("%s:%s", RedisPublicKey, userID)
+	fields, err := redisClient.HGetAll(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	if fields[publicHandleField] == "" {
+		return nil, nil
+	}
+	_, sharePrivate := fields[publicSharePrivateField]
+	return &PublicSettings{Handle: fields[publicHandleField], SharePrivate: sharePrivate}, nil
+}
+
+// setPublicSettings claims the handle for the user, giving up their old one.
+// Returns ErrHandleTaken if someone else has it.
+func setPublicSettings(redisClient redis.UniversalClient, userID string, settings *PublicSettings) error {
+	if !handleRegexp.MatchString(settings.Handle) {
+		return InvalidValueError{"handle", settings.Handle}
+	}
+	old, err := getPublicSettings(redisClient, userID)
+	if err != nil {
+		return err
+	}
+	handleKey := fmt.Sprintf("%s:%s", RedisHandleKey, settings.Handle)
+	ok, err := redisClient.SetNX(handleKey, userID, 0).Result()
+	if err != nil {
+		return fmt.Errorf("error while setting redis key %s: %w", handleKey, err)
+	}
+	if !ok {
+		owner, err := redisClient.Get(handleKey).Result()
+		if err != nil && err != redis.Nil {
+			return fmt.Errorf("couldn't get redis key %s: %w", handleKey, err)
+		}
+		if owner != userID {
+			return ErrHandleTaken
+		}
+	}
+
+	key := fmt.Sprintf("%s:%s", RedisPublicKey, userID)
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		if old != nil && old.Handle != settings.Handle {
+			pipe.Del(fmt.Sprintf("%s:%s", RedisHandleKey, old.Handle))
+		}
+		pipe.Del(key)
+		pipe.HSet(key, publicHandleField, settings.Handle)
+		if settings.SharePrivate {
+			pipe.HSet(key, publicSharePrivateField, "")
+		}
+		return nil
+	})
+	if err != nil {
+		// Give back a handle we've just claimed, so it isn't left taken by
+		// someone without public pages.
+		if ok {
+			if delErr := redisClient.Del(handleKey).Err(); delErr != nil {
+				return fmt.Errorf("couldn't save public settings: %w, or delete redis key %s: %s", err, handleKey, delErr)
+			}
+		}
+		return fmt.Errorf("couldn't save public settings: %w", err)
+	}
+	return nil
+}
+
+// deletePublicSettings turns off the user's public pages, freeing their handle.
+func deletePublicSettings(redisClient redis.UniversalClient, userID string) error {
+	old, err := getPublicSettings(redisClient, userID)
+	if err != nil || old == nil {
+		return err
+	}
+	key := fmt.Sprintf("%s:%s", RedisPublicKey, userID)
+	handleKey := fmt.Sprintf("%s:%s", RedisHandleKey, old.Handle)
+	err = deleteKeys(redisClient, key, handleKey)
+	if err != nil {
+		return fmt.Errorf("couldn't delete redis keys %s, %s: %w", key, handleKey, err)
+	}
+	return nil
+}
+
+// publicUserID returns the ID of the user with the handle.
+func publicUserID(redisClient redis.UniversalClient, handle string) (string, error) {
+	key := fmt.Sprintf("%s:%s", RedisHandleKey, handle)
+	userID, err := redisClient.Get(key).Result()
+	if err == redis.Nil {
+		return "", ErrPageNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	return userID, nil
+}
+
+// publicSnapshots returns the snapshots that can be shown publicly, newest
+// first.
+func publicSnapshots(snapshots []Snapshot, sharePrivate bool) []Snapshot {
+	var public []Snapshot
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !snapshots[i].Private || sharePrivate {
+			public = append(public, snapshots[i])
+		}
+	}
+	return public
+}
+
+// publicSnapshot returns the latest snapshot for the period that can be shown
+// publicly, or nil if there isn't one.
+func publicSnapshot(snapshots []Snapshot, period string, sharePrivate bool) *Snapshot {
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := &snapshots[i]
+		if s.Period == period && (!s.Private || sharePrivate) {
+			return s
+		}
+	}
+	return nil
+}
+
+// findPublicSnapshot returns the snapshot for the period of the user with the
+// handle, as long as it can be shown publicly, along with the user's ID.
+func findPublicSnapshot(redisClient redis.UniversalClient, handle, period string) (string, *Snapshot, error) {
+	userID, err := publicUserID(redisClient, handle)
+	if err != nil {
+		return "", nil, err
+	}
+	settings, err := getPublicSettings(redisClient, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	if settings == nil || settings.Handle != handle {
+		return "", nil, ErrPageNotFound
+	}
+	snapshots, err := Snapshots(redisClient, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	snapshot := publicSnapshot(snapshots, period, settings.SharePrivate)
+	if snapshot == nil {
+		return "", nil, ErrPageNotFound
+	}
+	return userID, snapshot, nil
+}
+
+// periodTitle describes the period, e.g. "August 2019" or "14 September 2019".
+func periodTitle(period string) string {
+	if t, err := time.Parse("2006-01", period); err == nil {
+		return t.Format("January 2006")
+	}
+	if t, err := time.Parse("2006-01-02", period); err == nil {
+		return t.Format("2 January 2006")
+	}
+	return period
+}
+
+// PublicSnapshot shows the tracks of a user's snapshot to anyone, if the user
+// has turned on public pages. Snapshots of private playlists are only shown if
+// the user has chosen to share them too.
+func PublicSnapshot(publicTmpl *template.Template, redisClient redis.UniversalClient, baseURL string, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		vars := mux.Vars(r)
+		// Handles are always stored lowercase.
+		handle, period := strings.ToLower(vars["handle"]), vars["period"]
+		userID, snapshot, err := findPublicSnapshot(redisClient, handle, period)
+		if err != nil {
+			return err
+		}
+		setRequestUser(r, logger, userID)
+
+		title := fmt.Sprintf("%s's top songs for %s", handle, periodTitle(period))
+		pageURL := fmt.Sprintf("%s/u/%s/%s", baseURL, url.PathEscape(handle), url.PathEscape(period))
+		w.WriteHeader(http.StatusOK)
+		return publicTmpl.Execute(w, map[string]interface{}{
+			"Title":       title,
+			"Description": fmt.Sprintf("%d songs %s listened to most, as a Spotify playlist.", len(snapshot.Tracks), handle),
+			"PageURL":     pageURL,
+			"CardURL":     pageURL + "/card.png",
+			"Snapshot":    snapshot,
+		})
+	}
+}
+
+// SetPublicPage turns the user's public pages on with the handle form value,
+// or off if it's empty.
+func SetPublicPage(store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
+
+		handle := strings.ToLower(strings.TrimSpace(r.FormValue("handle")))
+		if handle == "" {
+			err = deletePublicSettings(redisClient, userID)
+			if err != nil {
+				return err
+			}
+			logger.Info("turned off public pages")
+		} else {
+			err = setPublicSettings(redisClient, userID, &PublicSettings{
+				Handle:       handle,
+				SharePrivate: r.FormValue("share_private") != "",
+			})
+			if err != nil {
+				return err
+			}
+			logger.WithField("handle", handle).Info("turned on public pages")
+		}
+
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+}
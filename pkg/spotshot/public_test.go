@@ -0,0 +1,112 @@
+package spotshot
+
+import (
+	"errors"
+	"html/template"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+func TestPublicSnapshot(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	user := "coolkid99"
+	publicTmpl := template.Must(template.ParseFiles("../../templates/public.html.tmpl"))
+	handler := PublicSnapshot(publicTmpl, redisClient, "https://example.com", logrus.New())
+	get := func(handle, period string) (*httptest.ResponseRecorder, error) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/u/"+handle+"/"+period, nil)
+		r = mux.SetURLVars(r, map[string]string{"handle": handle, "period": period})
+		return w, handler(w, r)
+	}
+
+	for _, snapshot := range []*Snapshot{
+		{Period: "2019-07", PlaylistID: "jul", Name: "Your Top Songs Jul 19", Private: true},
+		{Period: "2019-08", PlaylistID: "aug", Name: "Your Top Songs Aug 19",
+			Tracks: []SnapshotTrack{{ID: "t1", Name: "Song", Artists: []SnapshotArtist{{Name: "Artist"}}, ImageURL: "https://i.scdn.co/image/1"}}},
+	} {
+		err = saveSnapshot(redisClient, user, snapshot)
+		if err != nil {
+			t.Fatalf("couldn't save snapshot: %s", err)
+		}
+	}
+
+	_, err = get("cool", "2019-08")
+	if !errors.Is(err, ErrPageNotFound) {
+		t.Errorf("expected ErrPageNotFound before public pages are turned on, got %v", err)
+	}
+
+	err = setPublicSettings(redisClient, user, &PublicSettings{Handle: "cool"})
+	if err != nil {
+		t.Fatalf("couldn't set public settings: %s", err)
+	}
+	err = setPublicSettings(redisClient, "someoneelse", &PublicSettings{Handle: "cool"})
+	if !errors.Is(err, ErrHandleTaken) {
+		t.Errorf("expected ErrHandleTaken, got %v", err)
+	}
+
+	w, err := get("cool", "2019-08")
+	if err != nil {
+		t.Fatalf("public page failed: %s", err)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`<meta property="og:title" content="cool&#39;s top songs for August 2019">`,
+		`<meta property="og:url" content="https://example.com/u/cool/2019-08">`,
+		`<meta property="og:image" content="https://example.com/u/cool/2019-08/card.png">`,
+		`<meta name="twitter:card" content="summary_large_image">`,
+		`<a href="https://open.spotify.com/track/t1">Song</a> by Artist`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected page to contain %s, got:\n%s", want, body)
+		}
+	}
+
+	// Handles aren't case sensitive.
+	w, err = get("Cool", "2019-08")
+	if err != nil {
+		t.Fatalf("public page failed for a capitalised handle: %s", err)
+	}
+	if want := `<meta property="og:url" content="https://example.com/u/cool/2019-08">`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("expected page to contain %s, got:\n%s", want, w.Body.String())
+	}
+
+	_, err = get("cool", "2019-07")
+	if !errors.Is(err, ErrPageNotFound) {
+		t.Errorf("expected private snapshot not to be shown, got %v", err)
+	}
+	err = setPublicSettings(redisClient, user, &PublicSettings{Handle: "cool", SharePrivate: true})
+	if err != nil {
+		t.Fatalf("couldn't set public settings: %s", err)
+	}
+	_, err = get("cool", "2019-07")
+	if err != nil {
+		t.Errorf("expected private snapshot to be shown once shared, got %v", err)
+	}
+
+	// Changing handle frees the old one.
+	err = setPublicSettings(redisClient, user, &PublicSettings{Handle: "cooler"})
+	if err != nil {
+		t.Fatalf("couldn't set public settings: %s", err)
+	}
+	_, err = get("cool", "2019-08")
+	if !errors.Is(err, ErrPageNotFound) {
+		t.Errorf("expected old handle to be freed, got %v", err)
+	}
+	err = setPublicSettings(redisClient, "someoneelse", &PublicSettings{Handle: "cool"})
+	if err != nil {
+		t.Errorf("expected old handle to be available, got %v", err)
+	}
+}
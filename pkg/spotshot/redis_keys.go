@@ -0,0 +1,63 @@
+package spotshot
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// scanBatchSize is how many keys SCAN is asked to look at each call.
+const scanBatchSize = 1000
+
+// scanKeys returns the keys matching pattern without blocking Redis like KEYS
+// does. On a Redis Cluster every master is scanned, since each only has some
+// of the keys.
+func scanKeys(redisClient redis.UniversalClient, pattern string) ([]string, error) {
+	cluster, ok := redisClient.(*redis.ClusterClient)
+	if !ok {
+		return scanNode(redisClient, pattern)
+	}
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(func(node *redis.Client) error {
+		nodeKeys, err := scanNode(node, pattern)
+		mu.Lock()
+		keys = append(keys, nodeKeys...)
+		mu.Unlock()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func scanNode(c redis.Cmdable, pattern string) ([]string, error) {
+	// SCAN can return a key more than once.
+	seen := make(map[string]bool)
+	var keys []string
+	iter := c.Scan(0, pattern, scanBatchSize).Iterator()
+	for iter.Next() {
+		if key := iter.Val(); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't scan redis keys %s: %w", pattern, err)
+	}
+	return keys, nil
+}
+
+// deleteKeys deletes each key with its own DEL, since on a Redis Cluster keys
+// can be in different slots, which one DEL can't span.
+func deleteKeys(redisClient redis.UniversalClient, keys ...string) error {
+	_, err := redisClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(key)
+		}
+		return nil
+	})
+	return err
+}
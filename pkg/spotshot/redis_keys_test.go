@@ -0,0 +1,45 @@
+package spotshot
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+)
+
+func TestScanAndDeleteKeys(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	for _, key := range []string{"spot_usr_id:a", "spot_usr_id:b", "spot_usr_hist:a"} {
+		s.Set(key, "x")
+	}
+
+	keys, err := scanKeys(redisClient, "spot_usr_id:*")
+	if err != nil {
+		t.Fatalf("couldn't scan keys: %s", err)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, " ") != "spot_usr_id:a spot_usr_id:b" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	err = deleteKeys(redisClient, keys...)
+	if err != nil {
+		t.Fatalf("couldn't delete keys: %s", err)
+	}
+	if s.Exists("spot_usr_id:a") || s.Exists("spot_usr_id:b") || !s.Exists("spot_usr_hist:a") {
+		t.Errorf("expected only the scanned keys to be deleted, got %v", s.Keys())
+	}
+	err = deleteKeys(redisClient)
+	if err != nil {
+		t.Errorf("expected deleting no keys to be fine, got %s", err)
+	}
+}
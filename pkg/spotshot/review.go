@@ -0,0 +1,348 @@
+package spotshot
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// yearReviewMonthPoints is what a track scores for each month it's in,
+	// on top of MaxNumSongs minus its rank. So being in more months counts for
+	// more than being higher up in one.
+	yearReviewMonthPoints = MaxNumSongs
+	// maxReviewTracks is how many tracks are in each list on the review page.
+	maxReviewTracks = 10
+)
+
+// ScoredTrack is a track's place in a year in review.
+type ScoredTrack struct {
+	Track SnapshotTrack
+	// Months is how many of the year's monthly snapshots the track is in.
+	Months int
+	Score  int
+	// BestRank is the track's highest place in a month, starting at 1, and
+	// BestPeriod is the month it was in.
+	BestRank   int
+	BestPeriod string
+}
+
+// BestMonth is the name of the month the track was highest in, e.g. "August".
+func (st ScoredTrack) BestMonth() string {
+	return monthName(st.BestPeriod)
+}
+
+// MonthArtist is the artist with the most tracks in a month.
+type MonthArtist struct {
+	Period string
+	Name   string
+	Tracks int
+}
+
+// Month is the name of the artist's month, e.g. "August".
+func (a MonthArtist) Month() string {
+	return monthName(a.Period)
+}
+
+// monthName turns a monthly period into the month's name.
+func monthName(period string) string {
+	t, err := time.Parse("2006-01", period)
+	if err != nil {
+		return period
+	}
+	return t.Format("January")
+}
+
+// YearReview is what a user listened to over a year, from their monthly
+// snapshots.
+type YearReview struct {
+	Year int
+	// Months is how many monthly snapshots there were.
+	Months int
+	// Tracks are every track in the year's snapshots, highest scoring first.
+	Tracks []ScoredTrack
+	// Persistent are the tracks in the most months.
+	Persistent []ScoredTrack
+	// OneMonthWonders are tracks only in one month, highest ranked first.
+	OneMonthWonders []ScoredTrack
+	TopArtists      []MonthArtist
+}
+
+// rankArtists orders the artists in a month's tracks by how many tracks they
+// have, then by how high up their tracks are.
+func rankArtists(period string, tracks []SnapshotTrack) []MonthArtist {
+	artists := make(map[string]*MonthArtist)
+	rankSums := make(map[string]int)
+	for i, track := range tracks {
+		for _, artist := range track.Artists {
+			if artists[artist.Name] == nil {
+				artists[artist.Name] = &MonthArtist{Period: period, Name: artist.Name}
+			}
+			artists[artist.Name].Tracks++
+			rankSums[artist.Name] += i
+		}
+	}
+	ranked := make([]MonthArtist, 0, len(artists))
+	for _, a := range artists {
+		ranked = append(ranked, *a)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.Tracks != b.Tracks {
+			return a.Tracks > b.Tracks
+		}
+		if rankSums[a.Name] != rankSums[b.Name] {
+			return rankSums[a.Name] < rankSums[b.Name]
+		}
+		return a.Name < b.Name
+	})
+	return ranked
+}
+
+// monthlySnapshots returns the latest monthly snapshot for each month with a
+// period starting with prefix, e.g. "2019-", in order.
+func monthlySnapshots(snapshots []Snapshot, prefix string) []Snapshot {
+	byPeriod := make(map[string]Snapshot)
+	for _, s := range snapshots {
+		if !s.OneOff && !s.Yearly && strings.HasPrefix(s.Period, prefix) {
+			byPeriod[s.Period] = s
+		}
+	}
+	months := make([]Snapshot, 0, len(byPeriod))
+	for _, s := range byPeriod {
+		months = append(months, s)
+	}
+	sort.Slice(months, func(i, j int) bool {
+		return months[i].Period < months[j].Period
+	})
+	return months
+}
+
+// newYearReview scores the tracks in the year's monthly snapshots.
+func newYearReview(snapshots []Snapshot, year int) *YearReview {
+	months := monthlySnapshots(snapshots, fmt.Sprintf("%d-", year))
+	review := &YearReview{Year: year, Months: len(months)}
+	scores := make(map[spotify.ID]*ScoredTrack)
+	var order []spotify.ID
+	for _, month := range months {
+		for i, track := range month.Tracks {
+			st, ok := scores[track.ID]
+			if !ok {
+				st = &ScoredTrack{Track: track, BestRank: i + 1, BestPeriod: month.Period}
+				scores[track.ID] = st
+				order = append(order, track.ID)
+			}
+			st.Months++
+			st.Score += yearReviewMonthPoints + MaxNumSongs - i
+			if i+1 < st.BestRank {
+				st.BestRank = i + 1
+				st.BestPeriod = month.Period
+			}
+		}
+		if artists := rankArtists(month.Period, month.Tracks); len(artists) > 0 {
+			review.TopArtists = append(review.TopArtists, artists[0])
+		}
+	}
+
+	for _, id := range order {
+		review.Tracks = append(review.Tracks, *scores[id])
+	}
+	sort.SliceStable(review.Tracks, func(i, j int) bool {
+		a, b := review.Tracks[i], review.Tracks[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.BestRank < b.BestRank
+	})
+	for _, st := range review.Tracks {
+		if st.Months > 1 {
+			review.Persistent = append(review.Persistent, st)
+		} else {
+			review.OneMonthWonders = append(review.OneMonthWonders, st)
+		}
+	}
+	sort.SliceStable(review.Persistent, func(i, j int) bool {
+		return review.Persistent[i].Months > review.Persistent[j].Months
+	})
+	sort.SliceStable(review.OneMonthWonders, func(i, j int) bool {
+		return review.OneMonthWonders[i].BestRank < review.OneMonthWonders[j].BestRank
+	})
+	if len(review.Persistent) > maxReviewTracks {
+		review.Persistent = review.Persistent[:maxReviewTracks]
+	}
+	if len(review.OneMonthWonders) > maxReviewTracks {
+		review.OneMonthWonders = review.OneMonthWonders[:maxReviewTracks]
+	}
+	return review
+}
+
+// reviewYears returns the years the user has monthly snapshots for, newest
+// first.
+func reviewYears(snapshots []Snapshot) []int {
+	seen := make(map[int]bool)
+	var years []int
+	for _, s := range snapshots {
+		if s.OneOff || s.Yearly || len(s.Period) < 4 {
+			continue
+		}
+		year, err := strconv.Atoi(s.Period[:4])
+		if err == nil && !seen[year] {
+			seen[year] = true
+			years = append(years, year)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(years)))
+	return years
+}
+
+// createYearReview makes a playlist of the user's top tracks from last year's
+// monthly snapshots and records it in their history. If they aren't due one,
+// no snapshot is returned.
+func createYearReview(key string, redisClient redis.UniversalClient, logger logrus.FieldLogger, GetSpotifyClient func(token *oauth2.Token) (SpotifyClienter, error)) (*Snapshot, error) {
+	year := timeNow().Year() - 1
+	logger.Infof("creating %d year in review playlist", year)
+
+	fields, err := redisClient.HGetAll(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	if _, ok := fields[NumSongsField]; !ok {
+		logger.Info("ignore year in review since not subscribed")
+		return nil, nil
+	}
+	if _, ok := fields[NeedsReauthField]; ok {
+		logger.Info("ignore year in review since authorization needs renewing")
+		return nil, nil
+	}
+	if fields[LastYearReviewField] == strconv.Itoa(year) {
+		logger.Info("ignore year in review since already made this year")
+		return nil, nil
+	}
+	numSongs, err := strconv.Atoi(fields[NumSongsField])
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get num songs: %w", err)
+	}
+	_, isPrivate := fields[IsPrivateField]
+
+	userID := strings.Split(key, ":")[1]
+	snapshots, err := Snapshots(redisClient, userID)
+	if err != nil {
+		return nil, err
+	}
+	review := newYearReview(snapshots, year)
+	if len(review.Tracks) == 0 {
+		logger.Info("ignore year in review since there are no monthly playlists")
+		return nil, nil
+	}
+	tracks := review.Tracks
+	if len(tracks) > numSongs {
+		tracks = tracks[:numSongs]
+	}
+
+	token := &oauth2.Token{RefreshToken: fields[RefreshTokenField]}
+	client, err := GetSpotifyClient(token)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't refresh token: %w", err)
+	}
+	spotClient := instrumentSpotifyClient(client)
+	playlistName := fmt.Sprintf("Your Year in Spotshot %d", year)
+	playlistDesc := fmt.Sprintf("Your top songs of %d from your monthly playlists, made by %s", year, DomainName)
+	fullPlaylist, err := spotClient.CreatePlaylistForUser(userID, playlistName, playlistDesc, !isPrivate)
+	if err != nil {
+		return nil, fmt.Errorf("err creating playlist for user: %w", err)
+	}
+	trackIDs := make([]spotify.ID, len(tracks))
+	snapTracks := make([]SnapshotTrack, len(tracks))
+	for i, st := range tracks {
+		trackIDs[i] = st.Track.ID
+		snapTracks[i] = st.Track
+	}
+	_, err = spotClient.AddTracksToPlaylist(fullPlaylist.ID, trackIDs...)
+	if err != nil {
+		return nil, fmt.Errorf("err adding tracks to playlist: %w", err)
+	}
+	period := strconv.Itoa(year)
+	cover, err := renderCover(userID, period)
+	if err == nil {
+		err = spotClient.SetPlaylistImage(fullPlaylist.ID, bytes.NewReader(cover))
+	}
+	if err != nil {
+		logger.Warnf("couldn't set playlist cover: %s", err)
+	}
+
+	snapshot := &Snapshot{
+		Period:     period,
+		Yearly:     true,
+		PlaylistID: fullPlaylist.ID,
+		Name:       playlistName,
+		Private:    isPrivate,
+		CreatedAt:  timeNow(),
+		Tracks:     snapTracks,
+	}
+	err = saveSnapshot(redisClient, userID, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	err = redisClient.HSet(key, LastYearReviewField, year).Err()
+	if err != nil {
+		return nil, fmt.Errorf("error while setting redis key %s: %w", LastYearReviewField, err)
+	}
+
+	logger.Infof("created %d year in review playlist", year)
+	return snapshot, nil
+}
+
+// Review shows the user's year in review for the year form value, or the
+// latest year they have playlists for.
+func Review(reviewTmpl *template.Template, store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
+
+		snapshots, err := Snapshots(redisClient, userID)
+		if err != nil {
+			return err
+		}
+		years := reviewYears(snapshots)
+		year := timeNow().Year()
+		if len(years) > 0 {
+			year = years[0]
+		}
+		if y := r.FormValue("year"); y != "" {
+			year, err = strconv.Atoi(y)
+			if err != nil {
+				return InvalidValueError{"year", y}
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return reviewTmpl.Execute(w, map[string]interface{}{
+			"Review": newYearReview(snapshots, year),
+			"Years":  years,
+		})
+	}
+}
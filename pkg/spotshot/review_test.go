@@ -0,0 +1,156 @@
+package spotshot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+	"golang.org/x/oauth2"
+)
+
+func reviewTrack(id, artist string) SnapshotTrack {
+	return SnapshotTrack{ID: spotify.ID(id), Name: "Song " + id, Artists: []SnapshotArtist{{Name: artist}}}
+}
+
+func TestNewYearReview(t *testing.T) {
+	a, b, c, d := reviewTrack("a", "ABBA"), reviewTrack("b", "Blur"), reviewTrack("c", "Blur"), reviewTrack("d", "Cher")
+	snapshots := []Snapshot{
+		{Period: "2018-12", Tracks: []SnapshotTrack{d}},
+		{Period: "2019-01", Tracks: []SnapshotTrack{b, a, c}},
+		{Period: "2019-02", Tracks: []SnapshotTrack{c, a}},
+		{Period: "2019-02-14", OneOff: true, Tracks: []SnapshotTrack{d}},
+		{Period: "2019-03", Tracks: []SnapshotTrack{d, a}},
+	}
+	review := newYearReview(snapshots, 2019)
+
+	if review.Months != 3 {
+		t.Errorf("expected 3 months, got %d", review.Months)
+	}
+	var order string
+	for _, st := range review.Tracks {
+		order += string(st.Track.ID)
+	}
+	if order != "acbd" {
+		t.Errorf("expected tracks scored in order acbd, got %s", order)
+	}
+	if len(review.Persistent) != 2 || review.Persistent[0].Track.ID != "a" || review.Persistent[0].Months != 3 {
+		t.Errorf("expected a then c to be persistent, got %+v", review.Persistent)
+	}
+	if len(review.OneMonthWonders) != 2 || review.OneMonthWonders[0].BestRank != 1 {
+		t.Errorf("expected 2 one-month wonders at number 1, got %+v", review.OneMonthWonders)
+	}
+	expected := []MonthArtist{{"2019-01", "Blur", 2}, {"2019-02", "Blur", 1}, {"2019-03", "Cher", 1}}
+	if fmt.Sprint(review.TopArtists) != fmt.Sprint(expected) {
+		t.Errorf("expected top artists %v, got %v", expected, review.TopArtists)
+	}
+}
+
+func TestRunPlaylistJobYearReview(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	user := "coolkid99"
+	key := fmt.Sprintf("%s:%s", RedisUserIDKey, user)
+	s.HSet(key, NumSongsField, "5")
+	s.HSet(key, RefreshTokenField, "test")
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	timeNow = func() time.Time { return time.Date(2020, time.January, 1, 0, 5, 0, 0, time.UTC) }
+	defer func() { timeNow = time.Now }()
+
+	// Track "x" is in every month before December, which the mock client
+	// gives tracks "0" to "4".
+	for month := 1; month <= 11; month++ {
+		snapshot := &Snapshot{
+			Period: fmt.Sprintf("2019-%02d", month),
+			Tracks: []SnapshotTrack{reviewTrack("x", "ABBA"), reviewTrack(fmt.Sprintf("m%d", month), "Blur")},
+		}
+		err = saveSnapshot(redisClient, user, snapshot)
+		if err != nil {
+			t.Fatalf("couldn't save snapshot: %s", err)
+		}
+	}
+
+	msc := &mockSpotifyClient{}
+	getClient := func(*oauth2.Token) (SpotifyClienter, error) { return msc, nil }
+	runPlaylistJob(key, false, "", redisClient, logger, getClient, Notifiers(nil))
+	if len(msc.playlists) != 2 {
+		t.Fatalf("expected December's playlist and the year in review, got %d playlists", len(msc.playlists))
+	}
+	yearly := msc.playlists[1]
+	if yearly.name != "Your Year in Spotshot 2019" {
+		t.Errorf("unexpected year in review name %s", yearly.name)
+	}
+	if len(yearly.tracks) != 5 || yearly.tracks[0] != "x" {
+		t.Errorf("expected 5 tracks starting with x, got %v", yearly.tracks)
+	}
+	snapshots, err := Snapshots(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't get snapshots: %s", err)
+	}
+	if last := snapshots[len(snapshots)-1]; !last.Yearly || last.Period != "2019" {
+		t.Errorf("expected year in review snapshot for 2019, got %+v", last)
+	}
+	jobs, err := Jobs(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't get jobs: %s", err)
+	}
+	if len(jobs) != 2 || jobs[0].Type != "yearly" || jobs[0].Err != "" {
+		t.Errorf("expected a successful yearly job, got %+v", jobs)
+	}
+
+	// Running again, e.g. after a restart, doesn't make another.
+	runPlaylistJob(key, false, "", redisClient, logger, getClient, Notifiers(nil))
+	if len(msc.playlists) != 2 {
+		t.Errorf("expected no more playlists, got %d", len(msc.playlists))
+	}
+}
+
+func TestRunPlaylistJobYearReviewAfterMonthlyFails(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	user := "coolkid99"
+	key := fmt.Sprintf("%s:%s", RedisUserIDKey, user)
+	s.HSet(key, NumSongsField, "5")
+	s.HSet(key, RefreshTokenField, "test")
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	timeNow = func() time.Time { return time.Date(2020, time.January, 1, 0, 5, 0, 0, time.UTC) }
+	defer func() { timeNow = time.Now }()
+
+	err = saveSnapshot(redisClient, user, &Snapshot{Period: "2019-11", Tracks: []SnapshotTrack{reviewTrack("x", "ABBA")}})
+	if err != nil {
+		t.Fatalf("couldn't save snapshot: %s", err)
+	}
+
+	// December's playlist fails, but the year in review is still made.
+	msc := &mockSpotifyClient{err: spotify.Error{Message: "Service unavailable", Status: 503}}
+	getClient := func(*oauth2.Token) (SpotifyClienter, error) { return msc, nil }
+	runPlaylistJob(key, false, "", redisClient, logger, getClient, Notifiers(nil))
+	if len(msc.playlists) != 1 || msc.playlists[0].name != "Your Year in Spotshot 2019" {
+		t.Fatalf("expected only the year in review, got %+v", msc.playlists)
+	}
+	jobs, err := Jobs(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't get jobs: %s", err)
+	}
+	if len(jobs) != 2 || jobs[0].Type != "yearly" || jobs[0].Err != "" || jobs[1].Type != "monthly" || jobs[1].Err == "" {
+		t.Errorf("expected a failed monthly job and a successful yearly one, got %+v", jobs)
+	}
+}
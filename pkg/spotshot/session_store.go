@@ -0,0 +1,187 @@
+package spotshot
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultSessionKeyPrefix is the prefix RedisStore gives session keys
+	// unless told otherwise.
+	DefaultSessionKeyPrefix = "session_"
+	// sessionRenewInterval is how often RenewSessions saves a session.
+	sessionRenewInterval = 24 * time.Hour
+)
+
+// RedisStore is a sessions.Store that keeps session data in Redis, so only
+// the signed session ID goes in the cookie. A session's expiry in Redis is
+// pushed back whenever it is loaded or saved, but its cookie's only when it's
+// saved, which RenewSessions does for logged in users.
+type RedisStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	// KeyPrefix is prepended to session IDs to make their Redis keys.
+	KeyPrefix string
+	client    redis.UniversalClient
+}
+
+// NewRedisStore returns a RedisStore using the given client. Key pairs are used
+// to sign and optionally encrypt the session ID cookie, see
+// securecookie.CodecsFromPairs.
+func NewRedisStore(client redis.UniversalClient, keyPairs ...[]byte) *RedisStore {
+	s := &RedisStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		KeyPrefix: DefaultSessionKeyPrefix,
+		client:    client,
+	}
+	s.MaxAge(s.Options.MaxAge)
+	return s
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (s *RedisStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+// If the request has a valid session cookie its data is loaded from Redis.
+func (s *RedisStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		// No cookie, so it's just a new session.
+		return session, nil
+	}
+	err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
+	if err != nil {
+		return session, err
+	}
+	found, err := s.load(session)
+	if err != nil {
+		return session, err
+	}
+	session.IsNew = !found
+	return session, nil
+}
+
+// Save writes the session to Redis and sets its cookie. Setting the session's
+// Options.MaxAge to zero or less deletes it.
+func (s *RedisStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		err := s.Delete(session.ID)
+		if err != nil {
+			return err
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(session.Values)
+	if err != nil {
+		return fmt.Errorf("couldn't encode session values: %w", err)
+	}
+	err = s.client.Set(s.KeyPrefix+session.ID, buf.Bytes(), s.expiry(session)).Err()
+	if err != nil {
+		return fmt.Errorf("couldn't save session to redis: %w", err)
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Delete removes the sessions with the given IDs from Redis.
+func (s *RedisStore) Delete(ids ...string) error {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != "" {
+			keys = append(keys, s.KeyPrefix+id)
+		}
+	}
+	err := deleteKeys(s.client, keys...)
+	if err != nil {
+		return fmt.Errorf("couldn't delete sessions from redis: %w", err)
+	}
+	return nil
+}
+
+// MaxAge sets the maximum age of new sessions and their cookies.
+func (s *RedisStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+// load reads the session's values from Redis, reporting whether they were found.
+// Loading a session also refreshes its expiry.
+func (s *RedisStore) load(session *sessions.Session) (bool, error) {
+	key := s.KeyPrefix + session.ID
+	b, err := s.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("couldn't get session from redis: %w", err)
+	}
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(&session.Values)
+	if err != nil {
+		return false, fmt.Errorf("couldn't decode session values: %w", err)
+	}
+	err = s.client.Expire(key, s.expiry(session)).Err()
+	if err != nil {
+		return false, fmt.Errorf("couldn't refresh session expiry: %w", err)
+	}
+	return true, nil
+}
+
+func (s *RedisStore) expiry(session *sessions.Session) time.Duration {
+	return time.Duration(session.Options.MaxAge) * time.Second
+}
+
+// RenewSessions is middleware that saves logged in users' sessions at most
+// once a day, so sessions expire a while after the user was last here rather
+// than after they logged in.
+func RenewSessions(store sessions.Store, logger logrus.FieldLogger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, err := store.Get(r, SessionName)
+			if err == nil && isLoggedIn(session) {
+				renewedAt, _ := session.Values[SessionRenewedAt].(int64)
+				if now := timeNow(); now.Sub(time.Unix(renewedAt, 0)) >= sessionRenewInterval {
+					session.Values[SessionRenewedAt] = now.Unix()
+					err = session.Save(r, w)
+					if err != nil {
+						RequestLogger(r, logger).Warnf("couldn't renew session: %s", err)
+					}
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package spotshot
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedisStoreSaveLoad(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	RegisterGobEncodings()
+	store := NewRedisStore(redisClient, []byte("authentication-key"))
+	store.KeyPrefix = "test_"
+
+	// Save a new session.
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := store.Get(r, SessionName)
+	if err != nil {
+		t.Fatalf("couldn't get session: %s", err)
+	}
+	if !session.IsNew {
+		t.Errorf("expected new session")
+	}
+	session.Values[SpotifyUserID] = "coolkid99"
+	w := httptest.NewRecorder()
+	err = session.Save(r, w)
+	if err != nil {
+		t.Fatalf("couldn't save session: %s", err)
+	}
+	if !s.Exists("test_" + session.ID) {
+		t.Fatalf("expected session to be saved with key prefix")
+	}
+
+	// Load it again with the cookie we were given. It should be there, and
+	// its expiry should be refreshed.
+	s.FastForward(time.Hour)
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	loaded, err := store.New(r, SessionName)
+	if err != nil {
+		t.Fatalf("couldn't load session: %s", err)
+	}
+	if loaded.IsNew {
+		t.Errorf("expected existing session")
+	}
+	if loaded.Values[SpotifyUserID] != "coolkid99" {
+		t.Errorf("expected user ID coolkid99, got %v", loaded.Values[SpotifyUserID])
+	}
+	if ttl := s.TTL("test_" + session.ID); ttl != time.Duration(store.Options.MaxAge)*time.Second {
+		t.Errorf("expected expiry to be refreshed, got %s", ttl)
+	}
+
+	// Delete it.
+	loaded.Options.MaxAge = -1
+	w = httptest.NewRecorder()
+	err = loaded.Save(r, w)
+	if err != nil {
+		t.Fatalf("couldn't delete session: %s", err)
+	}
+	if s.Exists("test_" + session.ID) {
+		t.Errorf("expected session to be deleted")
+	}
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SessionName {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.MaxAge >= 0 {
+		t.Errorf("expected session cookie to be expired, got %v", cookie)
+	}
+}
+
+func TestRedisStoreKeyRotation(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	RegisterGobEncodings()
+	oldKeys := [][]byte{[]byte("old-authentication-key"), []byte("old-encryption-key-32-bytes-long")}
+	newKeys := [][]byte{[]byte("new-authentication-key"), []byte("new-encryption-key-32-bytes-long")}
+
+	// Save a session with the old keys.
+	oldStore := NewRedisStore(redisClient, oldKeys...)
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := oldStore.Get(r, SessionName)
+	if err != nil {
+		t.Fatalf("couldn't get session: %s", err)
+	}
+	session.Values[SpotifyUserID] = "coolkid99"
+	w := httptest.NewRecorder()
+	err = session.Save(r, w)
+	if err != nil {
+		t.Fatalf("couldn't save session: %s", err)
+	}
+
+	// The session should still load once the keys are rotated.
+	store := NewRedisStore(redisClient, append(newKeys, oldKeys...)...)
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	loaded, err := store.New(r, SessionName)
+	if err != nil {
+		t.Fatalf("couldn't load session: %s", err)
+	}
+	if loaded.Values[SpotifyUserID] != "coolkid99" {
+		t.Errorf("expected user ID coolkid99, got %v", loaded.Values[SpotifyUserID])
+	}
+}
+
+func TestRenewSessions(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	RegisterGobEncodings()
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	store := NewRedisStore(redisClient, []byte("authentication-key"))
+	now := time.Unix(1000000, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+	handler := RenewSessions(store, logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	renews := func(cookies []*http.Cookie) []*http.Cookie {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result().Cookies()
+	}
+
+	// Sessions that aren't logged in are left alone.
+	if cookies := renews(nil); len(cookies) != 0 {
+		t.Errorf("expected no cookie without a session, got %v", cookies)
+	}
+
+	r := loggedInRequest(t, store, "GET", "/", "", "coolkid99")
+	cookies := renews(r.Cookies())
+	if len(cookies) != 1 || cookies[0].MaxAge != store.Options.MaxAge {
+		t.Fatalf("expected a renewed cookie, got %v", cookies)
+	}
+	if again := renews(cookies); len(again) != 0 {
+		t.Errorf("expected no renewal within a day, got %v", again)
+	}
+	now = now.Add(25 * time.Hour)
+	if again := renews(cookies); len(again) != 1 {
+		t.Errorf("expected the session to be renewed after a day, got %v", again)
+	}
+}
@@ -0,0 +1,213 @@
+package spotshot
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// RedisShareCardKey caches the user's rendered share cards by playlist ID.
+	RedisShareCardKey = "spot_usr_share_card"
+
+	// Share cards are the size recommended for OpenGraph images.
+	shareCardWidth  = 1200
+	shareCardHeight = 630
+	shareCardMargin = 60
+	// shareCardTracks is how many of the top tracks are on share cards.
+	shareCardTracks = 5
+	// shareCardCacheTTL is how long rendered share cards are kept after the
+	// last one was made.
+	shareCardCacheTTL = 7 * 24 * time.Hour
+)
+
+var (
+	shareCardBackground = color.RGBA{0x19, 0x14, 0x14, 0xff}
+	shareCardGreen      = color.RGBA{0x1d, 0xb9, 0x54, 0xff}
+	shareCardWhite      = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	shareCardGrey       = color.RGBA{0xb3, 0xb3, 0xb3, 0xff}
+	shareCardFace       = basicfont.Face7x13
+)
+
+// drawText draws a line of text with its top left corner at x, y. The font is
+// a small bitmap font, so it's scaled up by the given factor.
+func drawText(dst draw.Image, text string, x, y, scale int, c color.Color) {
+	d := &font.Drawer{Face: shareCardFace, Src: image.Opaque, Dot: fixed.P(0, shareCardFace.Ascent)}
+	width := d.MeasureString(text).Ceil()
+	mask := image.NewAlpha(image.Rect(0, 0, width, shareCardFace.Height))
+	d.Dst = mask
+	d.DrawString(text)
+
+	src := image.NewUniform(c)
+	for my := 0; my < shareCardFace.Height; my++ {
+		for mx := 0; mx < width; mx++ {
+			if mask.AlphaAt(mx, my).A == 0 {
+				continue
+			}
+			r := image.Rect(x+mx*scale, y+my*scale, x+(mx+1)*scale, y+(my+1)*scale)
+			draw.Draw(dst, r, src, image.Point{}, draw.Over)
+		}
+	}
+}
+
+// hasGlyph reports whether the share card font can draw r. The font's
+// GlyphAdvance can't be used, since it claims to have every rune.
+func hasGlyph(r rune) bool {
+	for _, rng := range shareCardFace.Ranges {
+		if rng.Low <= r && r < rng.High {
+			return true
+		}
+	}
+	return false
+}
+
+// fitText replaces characters the font doesn't have and shortens the text to
+// fit in width pixels at the given scale.
+func fitText(text string, width, scale int) string {
+	runes := []rune(text)
+	for i, r := range runes {
+		if hasGlyph(r) {
+			continue
+		}
+		// Try without accents, e.g. "é" is drawn as "e".
+		base := []rune(norm.NFD.String(string(r)))[0]
+		if hasGlyph(base) {
+			runes[i] = base
+		} else {
+			runes[i] = '?'
+		}
+	}
+	maxRunes := width / (shareCardFace.Advance * scale)
+	switch {
+	case len(runes) <= maxRunes:
+	case maxRunes < 3:
+		// There's no room for an ellipsis.
+		if maxRunes < 0 {
+			maxRunes = 0
+		}
+		runes = runes[:maxRunes]
+	default:
+		runes = append(runes[:maxRunes-3], '.', '.', '.')
+	}
+	return string(runes)
+}
+
+// renderShareCard draws a PNG of the snapshot's top tracks for sharing.
+func renderShareCard(w io.Writer, s *Snapshot, title string, logo image.Image) error {
+	img := image.NewRGBA(image.Rect(0, 0, shareCardWidth, shareCardHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(shareCardBackground), image.Point{}, draw.Src)
+	// A green stripe down the left side.
+	draw.Draw(img, image.Rect(0, 0, 16, shareCardHeight), image.NewUniform(shareCardGreen), image.Point{}, draw.Src)
+
+	textWidth := shareCardWidth - 2*shareCardMargin
+	if logo != nil {
+		b := logo.Bounds()
+		at := image.Pt(shareCardWidth-shareCardMargin-b.Dx(), shareCardMargin)
+		draw.Draw(img, b.Sub(b.Min).Add(at), logo, b.Min, draw.Over)
+		textWidth -= b.Dx() + shareCardMargin/2
+	}
+
+	y := shareCardMargin
+	drawText(img, fitText("MY TOP SONGS", textWidth, 3), shareCardMargin, y, 3, shareCardGrey)
+	y += 3*shareCardFace.Height + 10
+	drawText(img, fitText(title, textWidth, 5), shareCardMargin, y, 5, shareCardGreen)
+	y += 5*shareCardFace.Height + 40
+
+	for i, track := range topTracks(s, shareCardTracks) {
+		line := fmt.Sprintf("%d. %s", i+1, track.Name)
+		drawText(img, fitText(line, textWidth, 3), shareCardMargin, y, 3, shareCardWhite)
+		y += 3 * shareCardFace.Height
+		drawText(img, fitText("   "+track.ArtistNames(), textWidth, 2), shareCardMargin, y, 2, shareCardGrey)
+		y += 2*shareCardFace.Height + 12
+	}
+
+	brand := "SPOTSHOT"
+	drawText(img, brand, shareCardWidth-shareCardMargin-len(brand)*shareCardFace.Advance*3, shareCardHeight-shareCardMargin/2-3*shareCardFace.Height, 3, shareCardGreen)
+	return png.Encode(w, img)
+}
+
+// shareCard returns the PNG share card for the user's snapshot, rendering it
+// if it isn't cached. Snapshots don't change, so cards are cached by their
+// playlist ID.
+func shareCard(redisClient redis.UniversalClient, userID string, snapshot *Snapshot, logo image.Image, logger logrus.FieldLogger) ([]byte, error) {
+	key := fmt.Sprintf("%s:%s", RedisShareCardKey, userID)
+	field := string(snapshot.PlaylistID)
+	card, err := redisClient.HGet(key, field).Bytes()
+	if err == nil {
+		return card, nil
+	}
+	if err != redis.Nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+
+	var b bytes.Buffer
+	err = renderShareCard(&b, snapshot, periodTitle(snapshot.Period), logo)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't render share card: %w", err)
+	}
+	// The card can still be served if caching it fails.
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, field, b.Bytes())
+		pipe.Expire(key, shareCardCacheTTL)
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("error while setting redis key %s: %s", key, err)
+	}
+	return b.Bytes(), nil
+}
+
+// ShareCard serves a PNG image of a public snapshot's top tracks, which is
+// used as the image when links to public pages are shared.
+func ShareCard(redisClient redis.UniversalClient, logo image.Image, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		vars := mux.Vars(r)
+		userID, snapshot, err := findPublicSnapshot(redisClient, strings.ToLower(vars["handle"]), vars["period"])
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
+
+		card, err := shareCard(redisClient, userID, snapshot, logo, logger)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "image/png")
+		// Snapshots don't change, but they can stop being public.
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(card)
+		return err
+	}
+}
+
+// LoadShareCardLogo reads the PNG logo drawn on share cards.
+func LoadShareCardLogo(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode %s: %w", filename, err)
+	}
+	return img, nil
+}
@@ -0,0 +1,110 @@
+package spotshot
+
+import (
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+func TestShareCard(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	user := "coolkid99"
+	logo, err := LoadShareCardLogo("../../static/img/android-chrome-192x192.png")
+	if err != nil {
+		t.Fatalf("couldn't load logo: %s", err)
+	}
+	handler := ShareCard(redisClient, logo, logrus.New())
+	get := func(period string) (*httptest.ResponseRecorder, error) {
+		w := httptest.NewRecorder()
+		// Handles aren't case sensitive.
+		r := httptest.NewRequest("GET", "/u/Cool/"+period+"/card.png", nil)
+		r = mux.SetURLVars(r, map[string]string{"handle": "Cool", "period": period})
+		return w, handler(w, r)
+	}
+
+	for _, snapshot := range []*Snapshot{
+		{Period: "2019-07", PlaylistID: "jul", Private: true},
+		{Period: "2019-08", PlaylistID: "aug", Tracks: []SnapshotTrack{
+			{Name: "Song", Artists: []SnapshotArtist{{Name: "Artist"}}},
+			{Name: "ソング", Artists: []SnapshotArtist{{Name: "Artist"}}},
+		}},
+	} {
+		err = saveSnapshot(redisClient, user, snapshot)
+		if err != nil {
+			t.Fatalf("couldn't save snapshot: %s", err)
+		}
+	}
+	err = setPublicSettings(redisClient, user, &PublicSettings{Handle: "cool"})
+	if err != nil {
+		t.Fatalf("couldn't set public settings: %s", err)
+	}
+
+	_, err = get("2019-07")
+	if !errors.Is(err, ErrPageNotFound) {
+		t.Errorf("expected no card for private snapshot, got %v", err)
+	}
+	w, err := get("2019-08")
+	if err != nil {
+		t.Fatalf("share card failed: %s", err)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("expected image/png, got %s", ct)
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("couldn't decode share card: %s", err)
+	}
+	if b := img.Bounds(); b.Dx() != shareCardWidth || b.Dy() != shareCardHeight {
+		t.Errorf("expected %dx%d card, got %dx%d", shareCardWidth, shareCardHeight, b.Dx(), b.Dy())
+	}
+	if cc := w.Header().Get("Cache-Control"); cc == "" {
+		t.Errorf("expected a Cache-Control header")
+	}
+
+	// Cards are only rendered once.
+	key := fmt.Sprintf("%s:%s", RedisShareCardKey, user)
+	if s.HGet(key, "aug") == "" {
+		t.Fatalf("expected the card to be cached")
+	}
+	s.HSet(key, "aug", "cached card")
+	w, err = get("2019-08")
+	if err != nil {
+		t.Fatalf("share card failed: %s", err)
+	}
+	if body := w.Body.String(); body != "cached card" {
+		t.Errorf("expected the cached card, got %d bytes", len(body))
+	}
+}
+
+func TestFitText(t *testing.T) {
+	for _, tc := range []struct {
+		text, expected string
+		width          int
+	}{
+		{"Song", "Song", 100},
+		{"ソング", "???", 100},
+		{"Café", "Cafe", 100},
+		{"A very long song name", "A very...", 7 * 9},
+		{"Song", "So", 7 * 2},
+		{"Song", "", 0},
+		{"Song", "", -7},
+	} {
+		if got := fitText(tc.text, tc.width, 1); got != tc.expected {
+			t.Errorf("fitText(%q, %d) = %q, expected %q", tc.text, tc.width, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package spotshot
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+)
+
+const (
+	// maxArtistsPerRequest is the most artists Spotify gets at once.
+	maxArtistsPerRequest = 50
+	// maxStatsMonths is how many of the latest months are on the stats page.
+	maxStatsMonths = 12
+	// chartLines is how many artists or genres are drawn on each rank chart,
+	// and chartRanks is how far down the rankings it goes.
+	chartLines = 5
+	chartRanks = 10
+
+	// Rank chart layout, in pixels.
+	chartLeft   = 40
+	chartTop    = 20
+	chartRight  = 30
+	chartBottom = 30
+	chartColumn = 70
+	chartRow    = 24
+)
+
+var chartColours = []string{"#1db954", "#2785e8", "#e91e63", "#ffc862", "#af2896"}
+
+// addArtistGenres looks up the genres of the tracks' artists, so stats can be
+// worked out later without asking Spotify again.
+func addArtistGenres(spotClient SpotifyClienter, tracks []SnapshotTrack) error {
+	var ids []spotify.ID
+	seen := make(map[spotify.ID]bool)
+	for _, track := range tracks {
+		for _, artist := range track.Artists {
+			if artist.ID != "" && !seen[artist.ID] {
+				seen[artist.ID] = true
+				ids = append(ids, artist.ID)
+			}
+		}
+	}
+	genres := make(map[spotify.ID][]string)
+	for start := 0; start < len(ids); start += maxArtistsPerRequest {
+		end := start + maxArtistsPerRequest
+		if end > len(ids) {
+			end = len(ids)
+		}
+		artists, err := spotClient.GetArtists(ids[start:end]...)
+		if err != nil {
+			return fmt.Errorf("err fetching artists: %w", err)
+		}
+		for _, artist := range artists {
+			// Unknown artists are null.
+			if artist != nil {
+				genres[artist.ID] = artist.Genres
+			}
+		}
+	}
+	for i := range tracks {
+		for j := range tracks[i].Artists {
+			tracks[i].Artists[j].Genres = genres[tracks[i].Artists[j].ID]
+		}
+	}
+	return nil
+}
+
+// rankGenres orders the genres of a month's tracks by how many tracks are in
+// them, then by how high up the first one is.
+func rankGenres(tracks []SnapshotTrack) []string {
+	counts := make(map[string]int)
+	firstRanks := make(map[string]int)
+	for i, track := range tracks {
+		// Only count a genre once for a track with several artists in it.
+		seen := make(map[string]bool)
+		for _, artist := range track.Artists {
+			for _, genre := range artist.Genres {
+				if seen[genre] {
+					continue
+				}
+				seen[genre] = true
+				if counts[genre] == 0 {
+					firstRanks[genre] = i
+				}
+				counts[genre]++
+			}
+		}
+	}
+	genres := make([]string, 0, len(counts))
+	for genre := range counts {
+		genres = append(genres, genre)
+	}
+	sort.Slice(genres, func(i, j int) bool {
+		a, b := genres[i], genres[j]
+		if counts[a] != counts[b] {
+			return counts[a] > counts[b]
+		}
+		if firstRanks[a] != firstRanks[b] {
+			return firstRanks[a] < firstRanks[b]
+		}
+		return a < b
+	})
+	return genres
+}
+
+// shortMonth turns a monthly period into a short label, e.g. "Aug 19".
+func shortMonth(period string) string {
+	t, err := time.Parse("2006-01", period)
+	if err != nil {
+		return period
+	}
+	return t.Format("Jan 06")
+}
+
+// MonthStats are the stats of a monthly snapshot.
+type MonthStats struct {
+	Period string
+	Tracks int
+	// NewEntries and DropOuts are how many tracks came in and went out since
+	// the month before. The first month doesn't have a month before.
+	HasPrevious bool
+	NewEntries  int
+	DropOuts    int
+	// Genres is how many different genres the month's artists are in, which
+	// is none for snapshots made before genres were recorded.
+	Genres        int
+	TopGenre      string
+	AvgPopularity int
+}
+
+// Month is the name of the stats' month, e.g. "August 2019".
+func (m MonthStats) Month() string {
+	t, err := time.Parse("2006-01", m.Period)
+	if err != nil {
+		return m.Period
+	}
+	return t.Format("January 2006")
+}
+
+func newMonthStats(month Snapshot, previous *Snapshot) MonthStats {
+	stats := MonthStats{Period: month.Period, Tracks: len(month.Tracks)}
+	if previous != nil {
+		stats.HasPrevious = true
+		before := make(map[spotify.ID]bool)
+		for _, track := range previous.Tracks {
+			before[track.ID] = true
+		}
+		now := make(map[spotify.ID]bool)
+		for _, track := range month.Tracks {
+			now[track.ID] = true
+			if !before[track.ID] {
+				stats.NewEntries++
+			}
+		}
+		for id := range before {
+			if !now[id] {
+				stats.DropOuts++
+			}
+		}
+	}
+	genres := rankGenres(month.Tracks)
+	stats.Genres = len(genres)
+	if len(genres) > 0 {
+		stats.TopGenre = genres[0]
+	}
+	if len(month.Tracks) > 0 {
+		popularity := 0
+		for _, track := range month.Tracks {
+			popularity += track.Popularity
+		}
+		// Rounded to the nearest whole number.
+		stats.AvgPopularity = (2*popularity + len(month.Tracks)) / (2 * len(month.Tracks))
+	}
+	return stats
+}
+
+// ChartPoint is a point on a rank chart, with a tooltip.
+type ChartPoint struct {
+	X, Y  int
+	Title string
+}
+
+// ChartLabel is text on a rank chart's axes.
+type ChartLabel struct {
+	X, Y int
+	Text string
+}
+
+// ChartLine is how an artist or genre's rank changed. It's broken into
+// segments where they fell out of the chart.
+type ChartLine struct {
+	Name     string
+	Colour   string
+	Segments []string
+	Points   []ChartPoint
+}
+
+// RankChart is a chart of ranks over the months, drawn as an SVG by the
+// stats template.
+type RankChart struct {
+	Width, Height int
+	// Left and Right are where the first and last months are.
+	Left, Right int
+	MonthLabels []ChartLabel
+	RankLabels  []ChartLabel
+	Lines       []ChartLine
+}
+
+// newRankChart lays out a chart of the rankings for each period. The lines
+// are whatever is at the top in the latest period that has a ranking, to show
+// how they got there. Periods without one, e.g. if genres couldn't be fetched
+// for that playlist, are left as a gap.
+func newRankChart(periods []string, rankings [][]string) *RankChart {
+	latest := len(rankings) - 1
+	for latest >= 0 && len(rankings[latest]) == 0 {
+		latest--
+	}
+	if len(periods) == 0 || latest < 0 {
+		return nil
+	}
+	chart := &RankChart{
+		Width:  chartLeft + (len(periods)-1)*chartColumn + chartRight,
+		Height: chartTop + (chartRanks-1)*chartRow + chartBottom,
+	}
+	x := func(i int) int { return chartLeft + i*chartColumn }
+	y := func(rank int) int { return chartTop + (rank-1)*chartRow }
+	chart.Left, chart.Right = x(0), x(len(periods)-1)
+	for i, period := range periods {
+		chart.MonthLabels = append(chart.MonthLabels, ChartLabel{x(i), chart.Height - 8, shortMonth(period)})
+	}
+	for rank := 1; rank <= chartRanks; rank++ {
+		chart.RankLabels = append(chart.RankLabels, ChartLabel{chartLeft - 12, y(rank), fmt.Sprintf("#%d", rank)})
+	}
+
+	names := rankings[latest]
+	if len(names) > chartLines {
+		names = names[:chartLines]
+	}
+	for n, name := range names {
+		line := ChartLine{Name: name, Colour: chartColours[n%len(chartColours)]}
+		var segment []string
+		for i, ranking := range rankings {
+			rank := 0
+			for r, ranked := range ranking {
+				if ranked == name {
+					rank = r + 1
+					break
+				}
+			}
+			if rank == 0 || rank > chartRanks {
+				if len(segment) > 0 {
+					line.Segments = append(line.Segments, strings.Join(segment, " "))
+					segment = nil
+				}
+				continue
+			}
+			segment = append(segment, fmt.Sprintf("%d,%d", x(i), y(rank)))
+			title := fmt.Sprintf("%s: #%d in %s", name, rank, shortMonth(periods[i]))
+			line.Points = append(line.Points, ChartPoint{x(i), y(rank), title})
+		}
+		if len(segment) > 0 {
+			line.Segments = append(line.Segments, strings.Join(segment, " "))
+		}
+		chart.Lines = append(chart.Lines, line)
+	}
+	return chart
+}
+
+// ListeningStats are how a user's listening changed over their latest
+// monthly snapshots.
+type ListeningStats struct {
+	// Months are oldest first.
+	Months  []MonthStats
+	Artists *RankChart
+	// Genres is nil if none of the snapshots have genres.
+	Genres *RankChart
+}
+
+// newListeningStats works out the stats of the latest monthly snapshots.
+func newListeningStats(snapshots []Snapshot) *ListeningStats {
+	months := monthlySnapshots(snapshots, "")
+	if len(months) > maxStatsMonths {
+		months = months[len(months)-maxStatsMonths:]
+	}
+	stats := new(ListeningStats)
+	periods := make([]string, len(months))
+	artistRankings := make([][]string, len(months))
+	genreRankings := make([][]string, len(months))
+	for i, month := range months {
+		var previous *Snapshot
+		if i > 0 {
+			previous = &months[i-1]
+		}
+		stats.Months = append(stats.Months, newMonthStats(month, previous))
+		periods[i] = month.Period
+		for _, artist := range rankArtists(month.Period, month.Tracks) {
+			artistRankings[i] = append(artistRankings[i], artist.Name)
+		}
+		genreRankings[i] = rankGenres(month.Tracks)
+	}
+	stats.Artists = newRankChart(periods, artistRankings)
+	stats.Genres = newRankChart(periods, genreRankings)
+	return stats
+}
+
+// Stats shows how the user's top artists and genres changed over their
+// latest monthly snapshots.
+func Stats(statsTmpl *template.Template, store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		setRequestUser(r, logger, userID)
+
+		snapshots, err := Snapshots(redisClient, userID)
+		if err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return statsTmpl.Execute(w, map[string]interface{}{
+			"Stats": newListeningStats(snapshots),
+		})
+	}
+}
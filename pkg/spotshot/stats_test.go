@@ -0,0 +1,150 @@
+package spotshot
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+	"github.com/zmb3/spotify"
+)
+
+func statsTrack(id, artist string, popularity int, genres ...string) SnapshotTrack {
+	return SnapshotTrack{
+		ID:         spotify.ID(id),
+		Name:       "Song " + id,
+		Artists:    []SnapshotArtist{{ID: spotify.ID(artist), Name: artist, Genres: genres}},
+		Popularity: popularity,
+	}
+}
+
+func TestNewListeningStats(t *testing.T) {
+	snapshots := []Snapshot{
+		{Period: "2019-07", Tracks: []SnapshotTrack{statsTrack("a", "ABBA", 50), statsTrack("b", "Blur", 60)}},
+		{Period: "2019-08", Tracks: []SnapshotTrack{
+			statsTrack("b", "Blur", 60, "britpop"),
+			statsTrack("c", "Blur", 71, "britpop", "rock"),
+			statsTrack("d", "Cher", 90, "pop"),
+		}},
+		{Period: "2019-08-14", OneOff: true, Tracks: []SnapshotTrack{statsTrack("e", "Cher", 0)}},
+		{Period: "2019", Yearly: true, Tracks: []SnapshotTrack{statsTrack("e", "Cher", 0)}},
+	}
+	stats := newListeningStats(snapshots)
+
+	if len(stats.Months) != 2 {
+		t.Fatalf("expected 2 months, got %d", len(stats.Months))
+	}
+	july, august := stats.Months[0], stats.Months[1]
+	if july.HasPrevious || july.Genres != 0 || july.AvgPopularity != 55 {
+		t.Errorf("unexpected stats for July: %+v", july)
+	}
+	if !august.HasPrevious || august.NewEntries != 2 || august.DropOuts != 1 {
+		t.Errorf("expected 2 new entries and 1 drop-out in August, got %+v", august)
+	}
+	if august.Genres != 3 || august.TopGenre != "britpop" || august.AvgPopularity != 74 {
+		t.Errorf("unexpected genres or popularity for August: %+v", august)
+	}
+
+	if stats.Artists == nil || len(stats.Artists.Lines) != 2 {
+		t.Fatalf("expected a line for each of August's artists, got %+v", stats.Artists)
+	}
+	blur := stats.Artists.Lines[0]
+	if blur.Name != "Blur" || len(blur.Segments) != 1 || blur.Segments[0] != "40,44 110,20" {
+		t.Errorf("expected Blur to go from #2 to #1, got %+v", blur)
+	}
+	if cher := stats.Artists.Lines[1]; len(cher.Points) != 1 || cher.Points[0].Title != "Cher: #2 in Aug 19" {
+		t.Errorf("expected Cher to be new in August, got %+v", cher)
+	}
+	if stats.Genres == nil || stats.Genres.Lines[0].Name != "britpop" {
+		t.Errorf("expected britpop at the top of the genre chart, got %+v", stats.Genres)
+	}
+
+	// A month without genres, e.g. because they couldn't be fetched, is a
+	// gap in the genre chart rather than hiding it.
+	snapshots = append(snapshots[:2], Snapshot{Period: "2019-09", Tracks: []SnapshotTrack{statsTrack("d", "Cher", 90)}})
+	stats = newListeningStats(snapshots)
+	if stats.Genres == nil || stats.Genres.Lines[0].Name != "britpop" {
+		t.Fatalf("expected britpop at the top of the genre chart, got %+v", stats.Genres)
+	}
+	if britpop := stats.Genres.Lines[0]; len(britpop.Segments) != 1 || britpop.Segments[0] != "110,20" || len(stats.Genres.MonthLabels) != 3 {
+		t.Errorf("expected britpop only in August of a 3 month chart, got %+v", stats.Genres)
+	}
+
+	stats = newListeningStats(snapshots[:1])
+	if stats.Genres != nil {
+		t.Errorf("expected no genre chart without genres, got %+v", stats.Genres)
+	}
+}
+
+func TestAddArtistGenres(t *testing.T) {
+	tracks := []SnapshotTrack{statsTrack("a", "ABBA", 0), statsTrack("b", "ABBA", 0)}
+	for i := 0; i < maxArtistsPerRequest; i++ {
+		tracks = append(tracks, statsTrack(string(rune('c'+i)), string(rune('C'+i)), 0))
+	}
+	err := addArtistGenres(&mockSpotifyClient{}, tracks)
+	if err != nil {
+		t.Fatalf("couldn't add genres: %s", err)
+	}
+	for _, track := range tracks {
+		genres := track.Artists[0].Genres
+		if len(genres) != 1 || genres[0] != "genre "+string(track.Artists[0].ID) {
+			t.Errorf("unexpected genres for %s: %v", track.Artists[0].ID, genres)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	RegisterGobEncodings()
+	store := sessions.NewCookieStore([]byte("authentication-key"))
+	statsTmpl := template.Must(template.ParseFiles("../../templates/stats.html.tmpl"))
+	user := "coolkid99"
+
+	for _, snapshot := range []*Snapshot{
+		{Period: "2019-07", Tracks: []SnapshotTrack{statsTrack("a", "<ABBA>", 50)}},
+		{Period: "2019-08", Tracks: []SnapshotTrack{statsTrack("a", "<ABBA>", 50, "pop")}},
+	} {
+		err = saveSnapshot(redisClient, user, snapshot)
+		if err != nil {
+			t.Fatalf("couldn't save snapshot: %s", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	err = Stats(statsTmpl, store, redisClient, logger)(w, httptest.NewRequest("GET", "/stats", nil))
+	if err != ErrNotLoggedIn {
+		t.Errorf("expected ErrNotLoggedIn, got %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	err = Stats(statsTmpl, store, redisClient, logger)(w, loggedInRequest(t, store, "GET", "/stats", "", user))
+	if err != nil {
+		t.Fatalf("stats failed: %s", err)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`<polyline points="40,20 110,20" fill="none" stroke="#1db954" stroke-width="3" />`,
+		`<title>&lt;ABBA&gt;: #1 in Aug 19</title>`,
+		`<li><span style="background: #1db954"></span>&lt;ABBA&gt;</li>`,
+		`<td>August 2019</td>`,
+		`<td>pop</td>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected page to contain %s, got:\n%s", want, body)
+		}
+	}
+}
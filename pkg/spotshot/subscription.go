@@ -0,0 +1,135 @@
+package spotshot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// MaxNumSongs is the most songs Spotify will give us in a user's top tracks.
+const MaxNumSongs = 50
+
+// RedisSubscribersKey is a set of the subscribed user IDs, kept alongside
+// NumSongsField so they can be counted without going through every user.
+const RedisSubscribersKey = "spot_subscribers"
+
+// Subscription is a user's monthly playlist settings.
+type Subscription struct {
+	Subscribed  bool `json:"subscribed"`
+	NumSongs    int  `json:"num_songs"`
+	Private     bool `json:"private"`
+	NeedsReauth bool `json:"needs_reauth"`
+}
+
+// getSubscription fetches the user's subscription settings from Redis.
+func getSubscription(redisClient redis.UniversalClient, userID string) (*Subscription, error) {
+	key := fmt.Sprintf("%s:%s", RedisUserIDKey, userID)
+	fields, err := redisClient.HGetAll(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	sub := new(Subscription)
+	if numSongs, ok := fields[NumSongsField]; ok {
+		sub.Subscribed = true
+		sub.NumSongs, err = strconv.Atoi(numSongs)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse num songs: %w", err)
+		}
+	}
+	_, sub.Private = fields[IsPrivateField]
+	_, sub.NeedsReauth = fields[NeedsReauthField]
+	return sub, nil
+}
+
+// subscribe subscribes the user, or updates their settings if they already are.
+func subscribe(redisClient redis.UniversalClient, userID string, numSongs int, isPrivate bool) error {
+	if numSongs < 1 {
+		return InvalidValueError{"num_songs", numSongs}
+	}
+	if numSongs > MaxNumSongs {
+		numSongs = MaxNumSongs
+	}
+	key := fmt.Sprintf("%s:%s", RedisUserIDKey, userID)
+	_, err := redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, NumSongsField, numSongs)
+		// Redis doesn't have booleans. Let's just have the existence of the key indicate true.
+		if isPrivate {
+			pipe.HSet(key, IsPrivateField, "")
+		} else {
+			pipe.HDel(key, IsPrivateField)
+		}
+		pipe.SAdd(RedisSubscribersKey, userID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error while setting redis key: %w", err)
+	}
+	return nil
+}
+
+// unsubscribe stops the user getting monthly playlists. Their other details are kept.
+func unsubscribe(redisClient redis.UniversalClient, userID string) error {
+	key := fmt.Sprintf("%s:%s", RedisUserIDKey, userID)
+	_, err := redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HDel(key, NumSongsField)
+		pipe.SRem(RedisSubscribersKey, userID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't delete redis field %s in key %s: %w", NumSongsField, key, err)
+	}
+	return nil
+}
+
+// countSubscribers returns how many users are subscribed.
+func countSubscribers(redisClient redis.UniversalClient) (int, error) {
+	n, err := redisClient.SCard(RedisSubscribersKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't get redis key %s: %w", RedisSubscribersKey, err)
+	}
+	return int(n), nil
+}
+
+// SyncSubscribers rebuilds the set of subscribers from the users' settings.
+// It goes through every user, so it's only run at startup, to pick up users
+// that subscribed before the set existed.
+func SyncSubscribers(redisClient redis.UniversalClient) error {
+	keys, err := scanKeys(redisClient, fmt.Sprintf("%s:*", RedisUserIDKey))
+	if err != nil {
+		return err
+	}
+	pipe := redisClient.Pipeline()
+	cmds := make([]*redis.BoolCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HExists(key, NumSongsField)
+	}
+	_, err = pipe.Exec()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("couldn't get num songs: %w", err)
+	}
+	members, err := redisClient.SMembers(RedisSubscribersKey).Result()
+	if err != nil {
+		return fmt.Errorf("couldn't get redis key %s: %w", RedisSubscribersKey, err)
+	}
+	subscribed := make(map[string]bool)
+	pipe = redisClient.Pipeline()
+	for i, cmd := range cmds {
+		if cmd.Val() {
+			userID := strings.TrimPrefix(keys[i], RedisUserIDKey+":")
+			subscribed[userID] = true
+			pipe.SAdd(RedisSubscribersKey, userID)
+		}
+	}
+	for _, userID := range members {
+		if !subscribed[userID] {
+			pipe.SRem(RedisSubscribersKey, userID)
+		}
+	}
+	_, err = pipe.Exec()
+	if err != nil {
+		return fmt.Errorf("error while setting redis key %s: %w", RedisSubscribersKey, err)
+	}
+	return nil
+}
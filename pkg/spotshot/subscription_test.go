@@ -0,0 +1,65 @@
+package spotshot
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+)
+
+func TestCountSubscribers(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	count := func() int {
+		n, err := countSubscribers(redisClient)
+		if err != nil {
+			t.Fatalf("couldn't count subscribers: %s", err)
+		}
+		return n
+	}
+
+	for _, user := range []string{"coolkid99", "lamekid42"} {
+		err = subscribe(redisClient, user, 10, false)
+		if err != nil {
+			t.Fatalf("couldn't subscribe: %s", err)
+		}
+	}
+	// Changing settings doesn't count them twice.
+	err = subscribe(redisClient, "coolkid99", 20, true)
+	if err != nil {
+		t.Fatalf("couldn't subscribe: %s", err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("expected 2 subscribers, got %d", n)
+	}
+	err = unsubscribe(redisClient, "lamekid42")
+	if err != nil {
+		t.Fatalf("couldn't unsubscribe: %s", err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("expected 1 subscriber, got %d", n)
+	}
+
+	// Users that subscribed before the set existed are picked up by a sync,
+	// and stale members are dropped.
+	s.HSet(fmt.Sprintf("%s:%s", RedisUserIDKey, "oldkid01"), NumSongsField, "10")
+	s.SetAdd(RedisSubscribersKey, "lamekid42")
+	err = SyncSubscribers(redisClient)
+	if err != nil {
+		t.Fatalf("couldn't sync subscribers: %s", err)
+	}
+	members, err := s.Members(RedisSubscribersKey)
+	if err != nil {
+		t.Fatalf("couldn't get subscribers: %s", err)
+	}
+	if len(members) != 2 || members[0] != "coolkid99" || members[1] != "oldkid01" {
+		t.Errorf("expected subscribers coolkid99 and oldkid01, got %v", members)
+	}
+}
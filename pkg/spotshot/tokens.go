@@ -0,0 +1,363 @@
+package spotshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	RedisAPITokenKey   = "spot_api_token"
+	RedisUserTokensKey = "spot_usr_tokens"
+
+	// apiTokenPrefix makes Spotshot tokens easy to recognise, e.g. by secret scanners.
+	apiTokenPrefix = "sst_"
+)
+
+// API token scopes.
+const (
+	ScopeRead    = "read"
+	ScopeWrite   = "write"
+	ScopeTrigger = "trigger"
+)
+
+// Scopes are all the API token scopes.
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeTrigger}
+
+type contextKey int
+
+const apiTokenContextKey contextKey = 0
+
+// APIToken is a personal access token for the API. Only a hash of the token
+// itself is stored, which also serves as its ID.
+type APIToken struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"-"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+// HasScope reports whether the token was given the scope.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenAuth is middleware that authenticates requests with an
+// "Authorization: Bearer" header using a personal API token. Only requests
+// under pathPrefix are looked at, and authenticated ones skip CSRF checks,
+// since browsers don't send the header by themselves. It has to run before
+// CSRF protection, so it can't go on the API subrouter itself.
+func TokenAuth(redisClient redis.UniversalClient, pathPrefix string, logger logrus.FieldLogger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(r.URL.Path, pathPrefix+"/") || !strings.HasPrefix(auth, "Bearer ") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			token, err := lookupAPIToken(redisClient, strings.TrimPrefix(auth, "Bearer "))
+			if err != nil {
+				writeAPIError(w, err, RequestLogger(r, logger))
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), apiTokenContextKey, token))
+			next.ServeHTTP(w, csrf.UnsafeSkipCheck(r))
+		})
+	}
+}
+
+func apiTokenFromContext(ctx context.Context) *APIToken {
+	token, _ := ctx.Value(apiTokenContextKey).(*APIToken)
+	return token
+}
+
+// createAPIToken makes a new token for the user. The token is returned so it
+// can be shown to the user once, after which only its hash is kept.
+func createAPIToken(redisClient redis.UniversalClient, userID, name string, scopes []string, lifetime time.Duration) (string, error) {
+	if name == "" {
+		return "", ExpectedFormValueError{"name"}
+	}
+	if len(scopes) == 0 {
+		return "", ExpectedFormValueError{"scopes"}
+	}
+	for _, scope := range scopes {
+		if scope != ScopeRead && scope != ScopeWrite && scope != ScopeTrigger {
+			return "", InvalidValueError{"scopes", scope}
+		}
+	}
+	b, err := randToken(32)
+	if err != nil {
+		return "", fmt.Errorf("couldn't generate token: %w", err)
+	}
+	token := apiTokenPrefix + b
+	id := hashAPIToken(token)
+	now := timeNow()
+
+	key := fmt.Sprintf("%s:%s", RedisAPITokenKey, id)
+	userTokensKey := fmt.Sprintf("%s:%s", RedisUserTokensKey, userID)
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(key, map[string]interface{}{
+			"user_id":    userID,
+			"name":       name,
+			"scopes":     strings.Join(scopes, ","),
+			"created_at": now.Unix(),
+		})
+		if lifetime > 0 {
+			pipe.HSet(key, "expires_at", now.Add(lifetime).Unix())
+			pipe.ExpireAt(key, now.Add(lifetime))
+		}
+		pipe.SAdd(userTokensKey, id)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't save token: %w", err)
+	}
+	return token, nil
+}
+
+// lookupAPIToken finds the token and records that it was used.
+func lookupAPIToken(redisClient redis.UniversalClient, token string) (*APIToken, error) {
+	t, err := getAPIToken(redisClient, hashAPIToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if !t.ExpiresAt.IsZero() && timeNow().After(t.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+	key := fmt.Sprintf("%s:%s", RedisAPITokenKey, t.ID)
+	err = redisClient.HSet(key, "last_used_at", timeNow().Unix()).Err()
+	if err != nil {
+		return nil, fmt.Errorf("error while setting redis key %s: %w", key, err)
+	}
+	return t, nil
+}
+
+func getAPIToken(redisClient redis.UniversalClient, id string) (*APIToken, error) {
+	key := fmt.Sprintf("%s:%s", RedisAPITokenKey, id)
+	fields, err := redisClient.HGetAll(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	if len(fields) == 0 {
+		return nil, ErrInvalidToken
+	}
+	t := &APIToken{
+		ID:         id,
+		UserID:     fields["user_id"],
+		Name:       fields["name"],
+		Scopes:     strings.Split(fields["scopes"], ","),
+		CreatedAt:  unixField(fields, "created_at"),
+		ExpiresAt:  unixField(fields, "expires_at"),
+		LastUsedAt: unixField(fields, "last_used_at"),
+	}
+	return t, nil
+}
+
+// APITokens returns the user's tokens, newest first.
+func APITokens(redisClient redis.UniversalClient, userID string) ([]*APIToken, error) {
+	userTokensKey := fmt.Sprintf("%s:%s", RedisUserTokensKey, userID)
+	ids, err := redisClient.SMembers(userTokensKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", userTokensKey, err)
+	}
+	tokens := make([]*APIToken, 0, len(ids))
+	for _, id := range ids {
+		t, err := getAPIToken(redisClient, id)
+		if err == ErrInvalidToken {
+			// The token expired, so forget about it.
+			err = redisClient.SRem(userTokensKey, id).Err()
+			if err != nil {
+				return nil, fmt.Errorf("couldn't remove from redis key %s: %w", userTokensKey, err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+// revokeAPITokens deletes the user's tokens with the given IDs.
+func revokeAPITokens(redisClient redis.UniversalClient, userID string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	userTokensKey := fmt.Sprintf("%s:%s", RedisUserTokensKey, userID)
+	keys := make([]string, len(ids))
+	members := make([]interface{}, len(ids))
+	for i, id := range ids {
+		// Make sure users can only revoke their own tokens.
+		isMember, err := redisClient.SIsMember(userTokensKey, id).Result()
+		if err != nil {
+			return fmt.Errorf("couldn't get redis key %s: %w", userTokensKey, err)
+		}
+		if !isMember {
+			return ErrInvalidToken
+		}
+		keys[i] = fmt.Sprintf("%s:%s", RedisAPITokenKey, id)
+		members[i] = id
+	}
+	_, err := redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(key)
+		}
+		pipe.SRem(userTokensKey, members...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't revoke tokens: %w", err)
+	}
+	return nil
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func unixField(fields map[string]string, field string) time.Time {
+	secs, err := strconv.ParseInt(fields[field], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// Tokens shows the user's API tokens, along with forms to create and revoke them.
+func Tokens(tokensTmpl *template.Template, store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
+		return renderTokens(w, r, tokensTmpl, redisClient, userID, "")
+	}
+}
+
+// CreateToken makes a new API token and shows it to the user.
+func CreateToken(tokensTmpl *template.Template, store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
+
+		err = r.ParseForm()
+		if err != nil {
+			return fmt.Errorf("couldn't parse form: %w", err)
+		}
+		// Tokens only never expire if that's asked for by leaving the days
+		// blank, not by giving 0 days.
+		var lifetime time.Duration
+		if daysStr := r.FormValue("expires_in_days"); daysStr != "" {
+			days, err := strconv.Atoi(daysStr)
+			if err != nil || days < 1 {
+				return InvalidValueError{"expires_in_days", daysStr}
+			}
+			lifetime = time.Duration(days) * 24 * time.Hour
+		}
+		token, err := createAPIToken(redisClient, userID, r.FormValue("name"), r.Form["scopes"], lifetime)
+		if err != nil {
+			return err
+		}
+		logger.Infof("created API token")
+
+		return renderTokens(w, r, tokensTmpl, redisClient, userID, token)
+	}
+}
+
+// RevokeToken deletes one of the user's API tokens.
+func RevokeToken(store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
+
+		id := r.FormValue("id")
+		if id == "" {
+			return ExpectedFormValueError{"id"}
+		}
+		err = revokeAPITokens(redisClient, userID, id)
+		if err != nil {
+			return err
+		}
+		logger.Infof("revoked API token")
+
+		http.Redirect(w, r, "/tokens", http.StatusFound)
+		return nil
+	}
+}
+
+func renderTokens(w http.ResponseWriter, r *http.Request, tokensTmpl *template.Template, redisClient redis.UniversalClient, userID, newToken string) error {
+	tokens, err := APITokens(redisClient, userID)
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return tokensTmpl.Execute(w, map[string]interface{}{
+		"Tokens":    tokens,
+		"NewToken":  newToken,
+		"Scopes":    Scopes,
+		"CSRFField": csrf.TemplateField(r),
+	})
+}
@@ -0,0 +1,170 @@
+package spotshot
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+func TestTokenAuth(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	store := sessions.NewCookieStore([]byte("authentication-key"))
+	user := "coolkid99"
+
+	token, err := createAPIToken(redisClient, user, "cron", []string{ScopeRead}, time.Hour)
+	if err != nil {
+		t.Fatalf("couldn't create token: %s", err)
+	}
+	if s.Exists(hashAPIToken(token)) || len(s.Keys()) != 2 {
+		t.Errorf("expected only the token hash to be stored, got keys %v", s.Keys())
+	}
+
+	auth := TokenAuth(redisClient, "/api/v1", logger)
+	serve := func(scope, token string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/v1/subscription", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		auth(&APIEndpoint{
+			APIHandlerFunc: APIGetSubscription(redisClient),
+			Scope:          scope,
+			Store:          store,
+			Logger:         logger,
+		}).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve(ScopeRead, token); code != http.StatusOK {
+		t.Errorf("expected status %d with read scope, got %d", http.StatusOK, code)
+	}
+	if code := serve(ScopeWrite, token); code != http.StatusForbidden {
+		t.Errorf("expected status %d without write scope, got %d", http.StatusForbidden, code)
+	}
+	if code := serve(ScopeRead, "sst_nope"); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for unknown token, got %d", http.StatusUnauthorized, code)
+	}
+
+	tokens, err := APITokens(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't list tokens: %s", err)
+	}
+	if len(tokens) != 1 || tokens[0].LastUsedAt.IsZero() {
+		t.Fatalf("expected 1 used token, got %+v", tokens)
+	}
+	if err = revokeAPITokens(redisClient, "someoneelse", tokens[0].ID); err != ErrInvalidToken {
+		t.Errorf("expected other users to not be able to revoke the token, got %v", err)
+	}
+	err = revokeAPITokens(redisClient, user, tokens[0].ID)
+	if err != nil {
+		t.Fatalf("couldn't revoke token: %s", err)
+	}
+	if code := serve(ScopeRead, token); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for revoked token, got %d", http.StatusUnauthorized, code)
+	}
+}
+
+func TestTokenAuthOnlySkipsCSRFForAPI(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	token, err := createAPIToken(redisClient, "coolkid99", "cron", []string{ScopeWrite}, time.Hour)
+	if err != nil {
+		t.Fatalf("couldn't create token: %s", err)
+	}
+	handler := TokenAuth(redisClient, "/api/v1", logger)(csrf.Protect([]byte("32-byte-long-csrf-authentication"))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	serve := func(target string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", target, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve("/api/v1/subscription"); code != http.StatusOK {
+		t.Errorf("expected status %d for the API, got %d", http.StatusOK, code)
+	}
+	for _, target := range []string{"/settings", "/api/v10/subscription"} {
+		if code := serve(target); code != http.StatusForbidden {
+			t.Errorf("expected status %d for %s, got %d", http.StatusForbidden, target, code)
+		}
+	}
+}
+
+func TestCreateTokenExpiry(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	RegisterGobEncodings()
+	store := sessions.NewCookieStore([]byte("authentication-key"))
+	tokensTmpl := template.Must(template.ParseFiles("../../templates/tokens.html.tmpl"))
+	user := "coolkid99"
+
+	tests := []struct {
+		days    string
+		err     error
+		expires bool
+	}{
+		{"0", InvalidValueError{"expires_in_days", "0"}, false},
+		{"-1", InvalidValueError{"expires_in_days", "-1"}, false},
+		{"30", nil, true},
+		{"", nil, false},
+	}
+	for _, test := range tests {
+		r := loggedInRequest(t, store, "POST", "/tokens", "name=cron&scopes=read&expires_in_days="+test.days, user)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		err = CreateToken(tokensTmpl, store, redisClient, logger)(httptest.NewRecorder(), r)
+		if err != test.err {
+			t.Errorf("%q: expected error %v, got %v", test.days, test.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		tokens, err := APITokens(redisClient, user)
+		if err != nil {
+			t.Fatalf("couldn't list tokens: %s", err)
+		}
+		if len(tokens) != 1 {
+			t.Fatalf("%q: expected 1 token, got %d", test.days, len(tokens))
+		}
+		if tokens[0].ExpiresAt.IsZero() == test.expires {
+			t.Errorf("%q: expected token expiry to be set: %t, got %s", test.days, test.expires, tokens[0].ExpiresAt)
+		}
+		err = revokeAPITokens(redisClient, user, tokens[0].ID)
+		if err != nil {
+			t.Fatalf("couldn't revoke token: %s", err)
+		}
+	}
+}
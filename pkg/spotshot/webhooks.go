@@ -0,0 +1,529 @@
+package spotshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	RedisWebhooksKey     = "spot_usr_webhooks"
+	RedisWebhookLogKey   = "spot_usr_webhook_log"
+	RedisWebhookQueueKey = "spot_webhook_queue"
+
+	// maxWebhooks is how many webhooks each user can have.
+	maxWebhooks = 5
+	// maxWebhookLogRecords is how many delivery attempts are kept per user.
+	maxWebhookLogRecords = 50
+	webhookTimeout       = 10 * time.Second
+)
+
+var (
+	webhookPollFreq = time.Second
+	// webhookBackoff is how long to wait before each retry of a failed delivery.
+	webhookBackoff = []time.Duration{time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour}
+)
+
+// Webhook is a URL a user wants events sent to.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Type is empty for webhooks that get JSON events, or the chat app the
+	// webhook posts messages to, e.g. WebhookTypeDiscord.
+	Type string `json:"type,omitempty"`
+	// Secret signs deliveries, so receivers know they came from us.
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// webhookDelivery is an event waiting to be sent to a webhook.
+type webhookDelivery struct {
+	ID        string `json:"id"`
+	WebhookID string `json:"webhook_id"`
+	Event     *Event `json:"event"`
+	// Attempt is how many times delivery has been tried.
+	Attempt int `json:"attempt"`
+}
+
+// WebhookLogEntry is a record of an attempt to deliver an event.
+type WebhookLogEntry struct {
+	DeliveryID string    `json:"delivery_id"`
+	URL        string    `json:"url"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	Status     int       `json:"status,omitempty"`
+	Err        string    `json:"error,omitempty"`
+	Retrying   bool      `json:"retrying,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// WebhookSender queues events for users' webhooks and delivers them. The
+// queue is kept in Redis, so deliveries waiting to be retried survive restarts.
+type WebhookSender struct {
+	redisClient redis.UniversalClient
+	client      *http.Client
+	logger      logrus.FieldLogger
+}
+
+// NewWebhookSender creates a WebhookSender. Webhooks can't be sent to
+// private or loopback addresses, so users can't use them to poke around our
+// network.
+func NewWebhookSender(redisClient redis.UniversalClient, logger logrus.FieldLogger) *WebhookSender {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("webhook address %s isn't public", host)
+			}
+			return nil
+		},
+	}
+	return newWebhookSender(redisClient, &http.Transport{DialContext: dialer.DialContext}, logger)
+}
+
+func newWebhookSender(redisClient redis.UniversalClient, transport http.RoundTripper, logger logrus.FieldLogger) *WebhookSender {
+	return &WebhookSender{
+		redisClient: redisClient,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   webhookTimeout,
+			// Redirects could point anywhere, so treat them as failures.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		logger: logger,
+	}
+}
+
+// privateNets are the special-purpose ranges webhooks can't be sent to. IPv4
+// ranges also match IPv4-mapped IPv6 addresses, and NAT64 addresses are
+// blocked outright since they can reach any IPv4 address.
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15",
+		"198.51.100.0/24", "203.0.113.0/24", "240.0.0.0/4", "255.255.255.255/32",
+		"::1/128", "64:ff9b::/96", "2001:db8::/32", "fc00::/7", "fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Notify queues the event for each of the user's webhooks.
+func (s *WebhookSender) Notify(e *Event) error {
+	webhooks, err := Webhooks(s.redisClient, e.UserID)
+	if err != nil {
+		return err
+	}
+	for _, webhook := range webhooks {
+		if webhook.Type != "" && !chatEvents[e.Type] {
+			continue
+		}
+		id, err := randToken(12)
+		if err != nil {
+			return fmt.Errorf("couldn't generate delivery ID: %w", err)
+		}
+		err = s.enqueue(&webhookDelivery{ID: id, WebhookID: webhook.ID, Event: e}, timeNow())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WebhookSender) enqueue(d *webhookDelivery, at time.Time) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("couldn't encode webhook delivery: %w", err)
+	}
+	err = s.redisClient.ZAdd(RedisWebhookQueueKey, redis.Z{Score: float64(at.Unix()), Member: b}).Err()
+	if err != nil {
+		return fmt.Errorf("couldn't add to redis key %s: %w", RedisWebhookQueueKey, err)
+	}
+	return nil
+}
+
+// Run delivers queued events until the context is done.
+func (s *WebhookSender) Run(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(webhookPollFreq):
+		case <-ctx.Done():
+			return
+		}
+		due, err := s.redisClient.ZRangeByScore(RedisWebhookQueueKey, redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(timeNow().Unix(), 10),
+		}).Result()
+		if err != nil {
+			s.logger.Errorf("couldn't get redis key %s: %s", RedisWebhookQueueKey, err)
+			continue
+		}
+		for _, member := range due {
+			if ctx.Err() != nil {
+				return
+			}
+			// Removing the delivery claims it, in case another instance is
+			// also sending.
+			n, err := s.redisClient.ZRem(RedisWebhookQueueKey, member).Result()
+			if err != nil {
+				s.logger.Errorf("couldn't remove from redis key %s: %s", RedisWebhookQueueKey, err)
+				continue
+			}
+			if n == 0 {
+				continue
+			}
+			d := new(webhookDelivery)
+			err = json.Unmarshal([]byte(member), d)
+			if err != nil {
+				s.logger.Errorf("couldn't decode webhook delivery: %s", err)
+				continue
+			}
+			s.deliver(d)
+		}
+	}
+}
+
+// deliver tries to send the delivery, queueing it to be tried again later if
+// it fails.
+func (s *WebhookSender) deliver(d *webhookDelivery) {
+	logger := s.logger.WithFields(logrus.Fields{"user_id": d.Event.UserID, "delivery_id": d.ID})
+	webhook, err := getWebhook(s.redisClient, d.Event.UserID, d.WebhookID)
+	if err == ErrWebhookNotFound {
+		// The user deleted it.
+		return
+	}
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	d.Attempt++
+	entry := &WebhookLogEntry{
+		DeliveryID: d.ID,
+		URL:        webhook.URL,
+		Event:      d.Event.Type,
+		Attempt:    d.Attempt,
+		Time:       timeNow(),
+	}
+	entry.Status, err = s.post(webhook, d)
+	if err != nil {
+		entry.Err = err.Error()
+		if d.Attempt <= len(webhookBackoff) {
+			entry.Retrying = true
+			err = s.enqueue(d, timeNow().Add(webhookBackoff[d.Attempt-1]))
+			if err != nil {
+				logger.Error(err)
+			}
+		}
+		logger.Warnf("webhook delivery failed: %s", entry.Err)
+	}
+	err = saveWebhookLogEntry(s.redisClient, d.Event.UserID, entry)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// post sends the delivery to the webhook, returning the response status.
+func (s *WebhookSender) post(webhook *Webhook, d *webhookDelivery) (int, error) {
+	var body []byte
+	var err error
+	switch webhook.Type {
+	case WebhookTypeDiscord:
+		body, err = discordBody(d.Event)
+	case WebhookTypeSlack:
+		body, err = slackBody(d.Event)
+	default:
+		body, err = json.Marshal(map[string]interface{}{
+			"id":         d.ID,
+			"type":       d.Event.Type,
+			"created_at": d.Event.Time,
+			"user_id":    d.Event.UserID,
+			"data":       webhookData(d.Event),
+		})
+	}
+	if err != nil {
+		return 0, fmt.Errorf("couldn't encode webhook payload: %w", err)
+	}
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(timeNow().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Spotshot-Webhook")
+	req.Header.Set("X-Spotshot-Event", d.Event.Type)
+	req.Header.Set("X-Spotshot-Delivery", d.ID)
+	req.Header.Set("X-Spotshot-Timestamp", timestamp)
+	req.Header.Set("X-Spotshot-Signature", "sha256="+signWebhook(webhook.Secret, timestamp, body))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookData is the part of the payload specific to the event.
+func webhookData(e *Event) interface{} {
+	switch e.Type {
+	case EventSnapshotCreated:
+		return e.Snapshot
+	case EventChangesCreated:
+		return e.Changes
+	case EventSnapshotFailed:
+		return map[string]interface{}{"error": e.Err, "revoked": e.Revoked}
+	case EventSubscriptionChanged:
+		return e.Subscription
+	}
+	return nil
+}
+
+// signWebhook is the hex HMAC-SHA256 of the timestamp and body, joined with
+// a ".". Including the timestamp lets receivers reject old deliveries.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhooks returns the user's webhooks, oldest first.
+func Webhooks(redisClient redis.UniversalClient, userID string) ([]*Webhook, error) {
+	key := fmt.Sprintf("%s:%s", RedisWebhooksKey, userID)
+	vals, err := redisClient.HGetAll(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	webhooks := make([]*Webhook, 0, len(vals))
+	for _, val := range vals {
+		webhook := new(Webhook)
+		err = json.Unmarshal([]byte(val), webhook)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode webhook: %w", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+	})
+	return webhooks, nil
+}
+
+func getWebhook(redisClient redis.UniversalClient, userID, id string) (*Webhook, error) {
+	key := fmt.Sprintf("%s:%s", RedisWebhooksKey, userID)
+	val, err := redisClient.HGet(key, id).Result()
+	if err == redis.Nil {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	webhook := new(Webhook)
+	err = json.Unmarshal([]byte(val), webhook)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode webhook: %w", err)
+	}
+	return webhook, nil
+}
+
+// createWebhook adds a webhook of the given type for the user, giving it a
+// new secret.
+func createWebhook(redisClient redis.UniversalClient, userID, rawURL, webhookType string) (*Webhook, error) {
+	if rawURL == "" {
+		return nil, ExpectedFormValueError{"url"}
+	}
+	switch webhookType {
+	case "", WebhookTypeDiscord, WebhookTypeSlack:
+	default:
+		return nil, InvalidValueError{"type", webhookType}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, InvalidValueError{"url", rawURL}
+	}
+	key := fmt.Sprintf("%s:%s", RedisWebhooksKey, userID)
+	n, err := redisClient.HLen(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	if n >= maxWebhooks {
+		return nil, ErrTooManyWebhooks
+	}
+	id, err := randToken(12)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate webhook ID: %w", err)
+	}
+	secret, err := randToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate webhook secret: %w", err)
+	}
+	webhook := &Webhook{ID: id, URL: u.String(), Type: webhookType, Secret: secret, CreatedAt: timeNow()}
+	b, err := json.Marshal(webhook)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode webhook: %w", err)
+	}
+	err = redisClient.HSet(key, id, b).Err()
+	if err != nil {
+		return nil, fmt.Errorf("error while setting redis key %s: %w", key, err)
+	}
+	return webhook, nil
+}
+
+func deleteWebhook(redisClient redis.UniversalClient, userID, id string) error {
+	key := fmt.Sprintf("%s:%s", RedisWebhooksKey, userID)
+	n, err := redisClient.HDel(key, id).Result()
+	if err != nil {
+		return fmt.Errorf("couldn't delete from redis key %s: %w", key, err)
+	}
+	if n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func saveWebhookLogEntry(redisClient redis.UniversalClient, userID string, entry *WebhookLogEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("couldn't encode webhook log entry: %w", err)
+	}
+	key := fmt.Sprintf("%s:%s", RedisWebhookLogKey, userID)
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.LPush(key, b)
+		pipe.LTrim(key, 0, maxWebhookLogRecords-1)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't push to redis key %s: %w", key, err)
+	}
+	return nil
+}
+
+// WebhookLog returns the user's most recent delivery attempts, newest first.
+func WebhookLog(redisClient redis.UniversalClient, userID string) ([]WebhookLogEntry, error) {
+	key := fmt.Sprintf("%s:%s", RedisWebhookLogKey, userID)
+	vals, err := redisClient.LRange(key, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get redis key %s: %w", key, err)
+	}
+	entries := make([]WebhookLogEntry, len(vals))
+	for i, val := range vals {
+		err = json.Unmarshal([]byte(val), &entries[i])
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode webhook log entry: %w", err)
+		}
+	}
+	return entries, nil
+}
+
+// CreateWebhook adds a webhook for the user, of the type given by the type
+// form value.
+func CreateWebhook(store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
+
+		webhook, err := createWebhook(redisClient, userID, strings.TrimSpace(r.FormValue("url")), r.FormValue("type"))
+		if err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{"webhook_id": webhook.ID, "webhook_type": webhook.Type}).Info("created webhook")
+
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+}
+
+// DeleteWebhook removes one of the user's webhooks.
+func DeleteWebhook(store sessions.Store, redisClient redis.UniversalClient, logger logrus.FieldLogger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		logger := RequestLogger(r, logger)
+		// Fetch session.
+		session, err := store.Get(r, SessionName)
+		if err != nil {
+			logger.Warn(SessionFetchError{err})
+		}
+		if !isLoggedIn(session) {
+			return ErrNotLoggedIn
+		}
+		// Get user ID from session.
+		userID, err := sessionUserID(session)
+		if err != nil {
+			return err
+		}
+		logger = setRequestUser(r, logger, userID)
+
+		id := r.FormValue("id")
+		if id == "" {
+			return ExpectedFormValueError{"id"}
+		}
+		err = deleteWebhook(redisClient, userID, id)
+		if errors.Is(err, ErrWebhookNotFound) {
+			return InvalidValueError{"id", id}
+		}
+		if err != nil {
+			return err
+		}
+		logger.WithField("webhook_id", id).Info("deleted webhook")
+
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+}
@@ -0,0 +1,138 @@
+package spotshot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+)
+
+func TestWebhookSenderDeliver(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis run failed: %s", err)
+	}
+	defer s.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: s.Addr(),
+	})
+	user := "coolkid99"
+
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	reqs := make(chan request, 10)
+	status := http.StatusInternalServerError
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		reqs <- request{r.Header, body}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	webhook, err := createWebhook(redisClient, user, ts.URL, "")
+	if err != nil {
+		t.Fatalf("couldn't create webhook: %s", err)
+	}
+	sender := newWebhookSender(redisClient, http.DefaultTransport, logrus.New())
+	e := &Event{
+		Type:     EventSnapshotCreated,
+		UserID:   user,
+		Time:     timeNow(),
+		Snapshot: &Snapshot{Name: "Your Top Songs Aug 19", PlaylistID: "abc"},
+	}
+	err = sender.Notify(e)
+	if err != nil {
+		t.Fatalf("couldn't notify: %s", err)
+	}
+	queued, err := redisClient.ZRange(RedisWebhookQueueKey, 0, -1).Result()
+	if err != nil || len(queued) != 1 {
+		t.Fatalf("expected 1 queued delivery, got %d (%v)", len(queued), err)
+	}
+	d := new(webhookDelivery)
+	err = json.Unmarshal([]byte(queued[0]), d)
+	if err != nil {
+		t.Fatalf("couldn't decode delivery: %s", err)
+	}
+	redisClient.Del(RedisWebhookQueueKey)
+
+	// A failed delivery should be queued again.
+	sender.deliver(d)
+	req := <-reqs
+	timestamp := req.header.Get("X-Spotshot-Timestamp")
+	if sig := req.header.Get("X-Spotshot-Signature"); sig != "sha256="+signWebhook(webhook.Secret, timestamp, req.body) {
+		t.Errorf("signature %q doesn't match body", sig)
+	}
+	if event := req.header.Get("X-Spotshot-Event"); event != EventSnapshotCreated {
+		t.Errorf("expected event header %s, got %s", EventSnapshotCreated, event)
+	}
+	var payload struct {
+		ID   string    `json:"id"`
+		Type string    `json:"type"`
+		Data *Snapshot `json:"data"`
+	}
+	err = json.Unmarshal(req.body, &payload)
+	if err != nil {
+		t.Fatalf("couldn't decode payload: %s", err)
+	}
+	if payload.ID != d.ID || payload.Type != EventSnapshotCreated || payload.Data.PlaylistID != "abc" {
+		t.Errorf("unexpected payload: %s", req.body)
+	}
+	n, err := redisClient.ZCard(RedisWebhookQueueKey).Result()
+	if err != nil || n != 1 {
+		t.Errorf("expected failed delivery to be queued for retry, got %d (%v)", n, err)
+	}
+
+	status = http.StatusNoContent
+	sender.deliver(d)
+	<-reqs
+
+	entries, err := WebhookLog(redisClient, user)
+	if err != nil {
+		t.Fatalf("couldn't get webhook log: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 log entries, got %d", len(entries))
+	}
+	if entries[0].Attempt != 2 || entries[0].Status != http.StatusNoContent || entries[0].Err != "" {
+		t.Errorf("unexpected entry for successful delivery: %+v", entries[0])
+	}
+	if entries[1].Attempt != 1 || entries[1].Status != http.StatusInternalServerError || !entries[1].Retrying {
+		t.Errorf("unexpected entry for failed delivery: %+v", entries[1])
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for ip, expected := range map[string]bool{
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"192.168.0.10":     false,
+		"169.254.1.1":      false,
+		"::1":              false,
+		"0.0.0.0":          false,
+		"192.0.0.8":        false,
+		"192.0.2.1":        false,
+		"198.19.0.1":       false,
+		"198.51.100.1":     false,
+		"203.0.113.1":      false,
+		"250.1.2.3":        false,
+		"255.255.255.255":  false,
+		"::ffff:127.0.0.1": false,
+		"::ffff:10.0.0.1":  false,
+		"64:ff9b::a00:1":   false,
+		"2001:db8::1":      false,
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+	} {
+		if isPublicIP(net.ParseIP(ip)) != expected {
+			t.Errorf("expected isPublicIP(%s) to be %t", ip, expected)
+		}
+	}
+}